@@ -0,0 +1,74 @@
+package channel
+
+import (
+	"time"
+)
+
+// Programs aren't split into segments shorter than this
+const minSegment = 2 * time.Minute
+
+// withBreaks splits a program into segments with commercial breaks in between.
+// Returns the program as is if the channel doesn't have ads, or the program is
+// too short to split. The caller must hold s.genMu.
+func (s *schedule) withBreaks(si scheduleItem) []scheduleItem {
+	if len(s.ads) == 0 || s.cfg.BreakLength <= 0 {
+		return []scheduleItem{si}
+	}
+
+	length := si.end.Sub(si.start)
+	items := []scheduleItem{}
+	start := si.start
+	var from time.Duration
+
+	for _, at := range s.breakPoints(si.mediafile, length) {
+		segment := si
+		segment.offset = from
+		segment.start = start
+		segment.end = start.Add(at - from)
+		items = append(items, segment)
+
+		ads := s.padWith(s.ads, kindAd, segment.end, segment.end.Add(s.cfg.BreakLength))
+		items = append(items, ads...)
+
+		start = segment.end
+		if len(ads) > 0 {
+			start = ads[len(ads)-1].end
+		}
+		from = at
+	}
+
+	last := si
+	last.offset = from
+	last.start = start
+	last.end = start.Add(length - from)
+
+	return append(items, last)
+}
+
+// breakPoints returns where in a file of the given length to put commercial
+// breaks: at its chapter markers if it has any, otherwise every BreakInterval.
+// Breaks are at least BreakInterval apart, and never right at the start or the
+// end of the file.
+func (s *schedule) breakPoints(mf mediafile, length time.Duration) []time.Duration {
+	spacing := max(s.cfg.BreakInterval, minSegment)
+
+	candidates := mf.chapters
+	if len(candidates) == 0 && s.cfg.BreakInterval > 0 {
+		for at := s.cfg.BreakInterval; at < length; at += s.cfg.BreakInterval {
+			candidates = append(candidates, at)
+		}
+	}
+
+	points := []time.Duration{}
+	var last time.Duration
+	for _, at := range candidates {
+		if at-last < spacing || length-at < minSegment {
+			continue
+		}
+
+		points = append(points, at)
+		last = at
+	}
+
+	return points
+}
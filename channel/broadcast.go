@@ -0,0 +1,128 @@
+package channel
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"video-stream/log"
+)
+
+// What's on while the channel is off air, there's no file behind it, the
+// player shows a test card instead
+var offAirFile = mediafile{name: "Off air", show: "Off air"}
+
+// How long to show the test card for when there's nothing to play, before
+// checking the schedule again
+const testCardRetry = time.Minute
+
+// testCardArgs returns ffmpeg arguments for a test card input, colour bars
+// and a tone lasting length
+func testCardArgs(length time.Duration) []string {
+	t := strconv.FormatFloat(length.Seconds(), 'f', 3, 64)
+	return []string{
+		"-re", "-f", "lavfi", "-t", t, "-i", "smptehdbars=size=1920x1080:rate=25",
+		"-re", "-f", "lavfi", "-t", t, "-i", "sine=frequency=1000:sample_rate=48000",
+
+		"-map", "0:v:0",
+		"-map", "1:a:0",
+	}
+}
+
+// testCard is an off air item covering the time from now until length from
+// now, for when there's nothing scheduled to play
+func testCard(length time.Duration) scheduleItem {
+	now := time.Now()
+	return scheduleItem{
+		mediafile: offAirFile,
+		start:     now,
+		end:       now.Add(length),
+		kind:      kindOffAir,
+	}
+}
+
+// findSignClip returns the sign-on or sign-off clip at p, or nil if there
+// isn't one
+func findSignClip(p string, what string) *mediafile {
+	if p == "" {
+		return nil
+	}
+
+	if _, err := os.Stat(p); err != nil {
+		log.Error("could not find "+what+" clip", "path", p, "msg", err.Error())
+		return nil
+	}
+
+	return &mediafile{path: p}
+}
+
+// offAir reports whether the channel is off air at t, and if it is, when it
+// comes back on
+func (s *schedule) offAir(t time.Time) (time.Time, bool) {
+	hours := s.cfg.BroadcastHours
+	if hours == nil || hours.Contains(t) {
+		return time.Time{}, false
+	}
+
+	return hours.Start.Next(t), true
+}
+
+// closing returns when the channel has to start signing off, the first time
+// after t that it goes off air less the length of the sign-off clip
+func (s *schedule) closing(t time.Time) (time.Time, bool) {
+	hours := s.cfg.BroadcastHours
+	if hours == nil {
+		return time.Time{}, false
+	}
+
+	at := hours.End.Next(t)
+	if s.signOff != nil {
+		dur, _ := s.signOff.Duration() // a clip that can't be probed just gets cut short
+		at = at.Add(-dur)
+	}
+
+	return at, true
+}
+
+// signOffItems schedules the sign-off clip from start until the channel goes
+// off air, followed by the test card until it comes back on.
+// The caller must hold s.genMu.
+func (s *schedule) signOffItems(start time.Time) []scheduleItem {
+	items := []scheduleItem{}
+	hours := s.cfg.BroadcastHours
+
+	offAt := hours.End.Next(start)
+	if s.signOff != nil {
+		si := s.newItem(s.signOff, start)
+		si.kind = kindSignOff
+		si.fixed = true
+		si.end = offAt
+
+		items = append(items, si)
+		start = offAt
+	}
+
+	return append(items, s.offAirItems(start, hours.Start.Next(offAt))...)
+}
+
+// offAirItems schedules the test card from start until onAt, followed by the
+// sign-on clip if there is one.
+// The caller must hold s.genMu.
+func (s *schedule) offAirItems(start time.Time, onAt time.Time) []scheduleItem {
+	items := []scheduleItem{{
+		mediafile: offAirFile,
+		start:     start,
+		end:       onAt,
+		fixed:     true,
+		kind:      kindOffAir,
+	}}
+
+	if s.signOn != nil {
+		si := s.newItem(s.signOn, onAt)
+		si.kind = kindSignOn
+		si.fixed = true
+		items = append(items, si)
+	}
+
+	return items
+}
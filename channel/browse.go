@@ -0,0 +1,198 @@
+package channel
+
+import (
+	"cmp"
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrNoSuchShow = errors.New("no such show in the channel's library")
+
+// ShowSummary is a show in a channel's library
+type ShowSummary struct {
+	Name     string `json:"name"` // what the show is called in the config, e.g. for slots
+	Episodes int    `json:"episodes"`
+}
+
+// LibraryEntry is a file in a channel's library, with whatever is known about
+// it. Files that haven't been probed yet only have what their path and
+// sidecars say.
+type LibraryEntry struct {
+	Path        string        `json:"path"`
+	Show        string        `json:"show"`
+	ShowTitle   string        `json:"showTitle"`
+	Title       string        `json:"title"`
+	Season      int           `json:"season,omitempty"`
+	Episode     int           `json:"episode,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Duration    time.Duration `json:"duration,omitempty"`
+	HasArtwork  bool          `json:"hasArtwork"`
+	Probed      bool          `json:"probed"`
+}
+
+// Shows returns the shows in the channel's library, by name
+func (c *Channel) Shows() []ShowSummary {
+	catalog := c.schedule.browse()
+
+	out := make([]ShowSummary, 0, len(catalog))
+	for show, entries := range catalog {
+		out = append(out, ShowSummary{Name: show, Episodes: len(entries)})
+	}
+	slices.SortFunc(out, func(a, b ShowSummary) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	return out
+}
+
+// Episodes returns the files of a show in the channel's library, in season
+// and episode order
+func (c *Channel) Episodes(show string) ([]LibraryEntry, error) {
+	entries, ok := c.schedule.browse()[show]
+	if !ok {
+		return nil, ErrNoSuchShow
+	}
+
+	return slices.Clone(entries), nil
+}
+
+// Search returns the files in the channel's library whose title, show or path
+// has every word of query in it, ignoring case
+func (c *Channel) Search(query string) []LibraryEntry {
+	words := strings.Fields(strings.ToLower(query))
+
+	out := []LibraryEntry{}
+	for _, entries := range c.schedule.browse() {
+		for _, e := range entries {
+			text := strings.ToLower(strings.Join([]string{e.Title, e.Show, e.ShowTitle, e.Path}, "\n"))
+			matches := !slices.ContainsFunc(words, func(w string) bool {
+				return !strings.Contains(text, w)
+			})
+			if matches {
+				out = append(out, e)
+			}
+		}
+	}
+	sortEntries(out)
+
+	return out
+}
+
+// browse returns the snapshot of the library that's browsed, by show. It's
+// replaced rather than changed, don't change it either.
+func (s *schedule) browse() map[string][]LibraryEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.catalog
+}
+
+// refreshCatalog takes a new snapshot of the library to browse, for when the
+// library or what's known about its files has changed. Files keep what was
+// found out about them last time until they've been probed, so sidecars are
+// looked up once per file rather than on every request.
+// The caller must not hold s.genMu.
+func (s *schedule) refreshCatalog() {
+	s.catalogMu.Lock()
+	defer s.catalogMu.Unlock()
+
+	s.genMu.Lock()
+	files := s.libraryFiles()
+	s.genMu.Unlock()
+
+	known := map[string]LibraryEntry{}
+	for _, entries := range s.browse() {
+		for _, e := range entries {
+			known[e.Path] = e
+		}
+	}
+
+	catalog := make(map[string][]LibraryEntry, len(files))
+	for show, mfs := range files {
+		entries := make([]LibraryEntry, 0, len(mfs))
+		for _, mf := range mfs {
+			e, ok := known[mf.path]
+			if !ok || !e.Probed && inCache(mf.path) {
+				e = describe(mf)
+			}
+			entries = append(entries, e)
+		}
+		sortEntries(entries)
+		catalog[show] = entries
+	}
+
+	s.mu.Lock()
+	s.catalog = catalog
+	s.mu.Unlock()
+}
+
+// libraryFiles returns fresh copies of the files in the library, by show, so
+// their metadata can be filled in without getting in the way of the
+// scheduler's.
+// The caller must hold s.genMu.
+func (s *schedule) libraryFiles() map[string][]*mediafile {
+	out := make(map[string][]*mediafile, len(s.media))
+	for show, files := range s.media {
+		out[show] = make([]*mediafile, len(files))
+		for i, mf := range files {
+			out[show][i] = &mediafile{path: mf.path, show: mf.show, dirSeason: mf.dirSeason}
+		}
+	}
+
+	return out
+}
+
+// describe fills in mf's details from the metadata cache, without probing it,
+// and returns them
+func describe(mf *mediafile) LibraryEntry {
+	e := LibraryEntry{Path: mf.path, Show: mf.show}
+
+	if stat, err := os.Stat(mf.path); err == nil {
+		if info, ok := metadata.get(mf.path, stat); ok {
+			mf.setInfo(info)
+			e.Probed = true
+		}
+	}
+	if !e.Probed {
+		mf.loadSidecars()
+	}
+
+	e.ShowTitle = mf.ShowTitle()
+	e.Title = mf.name
+	if e.Title == "" || e.Title == mf.path {
+		e.Title = strings.TrimSuffix(path.Base(mf.path), path.Ext(mf.path))
+	}
+	e.Season = mf.season
+	e.Episode = mf.episode
+	e.Description = mf.description
+	e.Duration = mf.duration
+	e.HasArtwork = mf.artwork != ""
+
+	return e
+}
+
+// inCache reports whether the file at p has been probed since it last changed
+func inCache(p string) bool {
+	stat, err := os.Stat(p)
+	if err != nil {
+		return false
+	}
+
+	_, ok := metadata.get(p, stat)
+	return ok
+}
+
+func sortEntries(entries []LibraryEntry) {
+	slices.SortStableFunc(entries, func(a, b LibraryEntry) int {
+		return cmp.Or(
+			cmp.Compare(a.Show, b.Show),
+			cmp.Compare(a.Season, b.Season),
+			cmp.Compare(a.Episode, b.Episode),
+			cmp.Compare(path.Base(a.Path), path.Base(b.Path)),
+		)
+	})
+}
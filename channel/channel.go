@@ -3,12 +3,14 @@ package channel
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os/exec"
 	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"video-stream/config"
 	"video-stream/log"
 )
 
@@ -29,18 +31,20 @@ type Channel struct {
 	nowPlaying  *mediafile
 }
 
-// New creates a new Channel with the given name and a list of show file paths.
-// The channel maintains its own client connection list and a schedule to pick
-// media files from.
-func New(name string, shows []string) *Channel {
+// New creates a new Channel with the given name and configuration. The channel
+// maintains its own client connection list and a schedule to pick media files
+// from.
+func New(name string, cfg config.Channel) *Channel {
 	strMap := make(map[chan []byte]struct{})
 	playChan := make(chan playRequest)
 	stopChan := make(chan stopRequest)
 	skipChan := make(chan skipRequest)
 
+	statePath := path.Join(config.Current.StateDir, pathName(name)+".schedule.json")
+
 	return &Channel{
 		name:     name,
-		schedule: newSchedule(shows),
+		schedule: newSchedule(cfg, statePath),
 		connections: &connectionList{
 			streams: strMap,
 		},
@@ -56,7 +60,13 @@ func (c *Channel) Name() string {
 }
 
 func (c *Channel) PathName() string {
-	return strings.ToLower(strings.ReplaceAll(c.name, " ", "-"))
+	return pathName(c.name)
+}
+
+// pathName turns a channel name into something that can be used in URLs and
+// file names
+func pathName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, " ", "-"))
 }
 
 func (c *Channel) Count() int {
@@ -128,22 +138,15 @@ func (c *Channel) AddClient() (chan []byte, func()) {
 // Start blocks until the provided context is canceled. Only one goroutine
 // should call Start for a given Channel instance.
 func (c *Channel) Start(ctx context.Context) error {
-	// Channel schedule generation skipped for now, as it isn't used in practice
-	// generated, err := c.schedule.generate(ctx)
-	// if err != nil {
-	// 	log.Error("Could not generate schedule", "channel", c.Name(), "error", err.Error())
-	// 	return err
-	// }
-
-	// for _, g := range generated {
-	// 	log.Debug(g.mediafile.path)
-	// }
-
-	// log.Info("Schedule generation complete", "channel", c.Name())
-
 	childCtx, cancelCtx := context.WithCancel(ctx)
 	defer cancelCtx()
 
+	// Keep the schedule topped up and the library up to date in the background
+	go c.schedule.maintain(childCtx)
+	go c.schedule.refreshCatalog()
+	go c.schedule.probeAll(childCtx, c.Name())
+	go c.schedule.watch(childCtx, c.Name())
+
 	var cancelPlayer func()
 
 	for {
@@ -164,6 +167,56 @@ func (c *Channel) Start(ctx context.Context) error {
 	}
 }
 
+// outputArgs returns the ffmpeg arguments that turn whatever's playing into the
+// stream clients get, encoded the way the profile says. Streams the source
+// already has the way the profile wants them can be sent as they are.
+func outputArgs(p config.Profile, direct directStream) []string {
+	args := []string{}
+
+	if direct.video {
+		args = append(args, "-c:v", "copy")
+	} else {
+		// Scale to fit and letterbox, so every file comes out the same size
+		filter := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2", p.Width, p.Height, p.Width, p.Height)
+		if p.FrameRate != "" {
+			filter += ",fps=" + p.FrameRate
+		}
+
+		// Re-encode video
+		args = append(args, "-c:v", p.VideoCodec)
+		if p.Preset != "" {
+			args = append(args, "-preset", p.Preset)
+		}
+		switch {
+		case p.VideoBitrate != "":
+			args = append(args, "-b:v", p.VideoBitrate)
+		case p.CRF > 0:
+			args = append(args, "-crf", strconv.Itoa(p.CRF))
+		}
+		if p.GOP > 0 {
+			args = append(args, "-g", strconv.Itoa(p.GOP))
+		}
+		args = append(args, "-vf", filter)
+	}
+
+	if direct.audio {
+		args = append(args, "-c:a", "copy")
+	} else {
+		// Re-encode audio
+		args = append(args,
+			"-c:a", p.AudioCodec,
+			"-ar", strconv.Itoa(p.SampleRate),
+			"-ac", strconv.Itoa(p.AudioChannels),
+			"-b:a", p.AudioBitrate,
+		)
+	}
+
+	return append(args,
+		"-f", "mpegts", // format into mpegts so we can just dump it over http
+		"pipe:1", // use stdout so we can pipe it into our go program
+	)
+}
+
 // Returns a boolean indicating if a skip request was made
 func (c *Channel) SkipFile() bool {
 	if c.state == PlayerPlaying {
@@ -187,11 +240,68 @@ func (c *Channel) startPlayer(ctx context.Context) func() {
 	childCtx, cancelCtx := context.WithCancel(ctx)
 
 	go func() {
+		var last *scheduleItem
+
+		// Clients see the standby slate until the first file starts playing
+		stopStandby := c.standby(childCtx)
+		defer stopStandby()
+
+		// Waits a little longer each time playback fails in a row, returns
+		// false if the player was stopped meanwhile
+		var backoff time.Duration
+		wait := func(err error) bool {
+			if err == nil {
+				backoff = 0
+				return true
+			}
+
+			backoff = min(max(2*backoff, failureBackoff), maxFailureBackoff)
+			log.Warn("[startPlayer] playback failed, waiting before playing on", "error", err.Error(), "wait", backoff, "channel", c.Name())
+			select {
+			case <-childCtx.Done():
+				return false
+			case <-time.After(backoff):
+				return true
+			}
+		}
+
 		for {
-			log.Debug("[startPlayer] Starting stream", "channel", c.Name())
-			mf := c.schedule.randomFile()
-			c.nowPlaying = &mf
-			c.streamFile(mf, childCtx)
+			item, offset, err := c.nextItem(childCtx, last)
+			if err != nil {
+				if childCtx.Err() != nil {
+					log.Error("[startPlayer] could not get next item from schedule", "error", err.Error(), "channel", c.Name())
+					return
+				}
+
+				// Show the test card rather than nothing at all, and check again after
+				log.Error("[startPlayer] could not get next item from schedule, showing test card", "error", err.Error(), "channel", c.Name())
+				card := testCard(testCardRetry)
+				c.nowPlaying = &card.mediafile
+				if _, err := c.streamFile(card, 0, childCtx, stopStandby); !wait(err) {
+					return
+				}
+				last = nil
+				continue
+			}
+
+			log.Debug("[startPlayer] Starting stream", "channel", c.Name(), "offset", offset)
+			c.nowPlaying = &item.mediafile
+			skipped, err := c.streamFile(item, offset, childCtx, stopStandby)
+			if !wait(err) {
+				return
+			}
+			switch {
+			case item.kind == kindOffAir:
+				// There's nothing to skip to while off air, the test card just starts over
+			case skipped:
+				c.schedule.skip(item.start, time.Now())
+			case childCtx.Err() == nil && time.Until(item.end) > earlyEndSlack:
+				// ffmpeg finished well before it was meant to, move everything
+				// after it up so the schedule says what's actually on
+				log.Info("[startPlayer] file ended early, moving the schedule up", "channel", c.Name(), "early", time.Until(item.end).Round(time.Second))
+				c.schedule.skip(item.start, time.Now())
+			}
+			last = &item
 			log.Debug("[startPlayer] Stream finished", "channel", c.Name())
 
 			select {
@@ -211,75 +321,173 @@ func (c *Channel) startPlayer(ctx context.Context) func() {
 	return cancelCtx
 }
 
-// Starts an ffmpeg process that publishes mpeg-ts data to all connections
-func (c *Channel) streamFile(f mediafile, ctx context.Context) {
+// nextItem decides what the player should play next and how far into it
+// playback should start. Normally that's whatever the schedule says is on air
+// right now, but if that's the item that was just played (because ffmpeg
+// finished a little early, or failed) the player moves on to the item after it
+// instead of replaying the tail end.
+func (c *Channel) nextItem(ctx context.Context, last *scheduleItem) (scheduleItem, time.Duration, error) {
+	item, offset, err := c.schedule.itemAt(ctx, time.Now())
+	if err != nil {
+		return scheduleItem{}, 0, err
+	}
 
-	var audioMap string
-	if f.hasEnglishAudio() {
-		log.Debug("Mapping eng audio stream")
-		audioMap = "0:a:m:language:eng"
-	} else {
-		log.Debug("Mapping all audio streams")
-		audioMap = "0:a"
+	if last != nil && !item.start.After(last.start) {
+		item, err = c.schedule.itemAfter(ctx, last.start)
+		return item, 0, err
 	}
 
-	ffmpegArgs := []string{
-		// Avoid timestamp funkiness
-		"-fflags", "+genpts",
-		"-avoid_negative_ts", "make_zero",
+	return item, offset, nil
+}
 
-		// Get input
-		// "-sseof", "-10", // start N seconds from the end
-		// "-ss", "45", // skip the first 45 seconds
-		"-re", // throttle to realtime
-		"-i", f.path,
+// Starts an ffmpeg process that publishes mpeg-ts data to all connections,
+// starting offset into the item and stopping when the item is scheduled to
+// end. Items can be a segment of a file, in which case only that part of the
+// file is played. onOutput is called before each chunk of output is
+// published. Returns true if playback was ended by a skip request, or why
+// playback failed.
+func (c *Channel) streamFile(item scheduleItem, offset time.Duration, ctx context.Context, onOutput func()) (bool, error) {
+	f := item.mediafile
+
+	profile := c.schedule.cfg.Transcode
+	var direct directStream
+
+	english := false
+	if item.kind != kindOffAir {
+		english = f.hasEnglishAudio()
+		if profile.DirectStream {
+			if info, err := cachedProbe(f.path); err != nil {
+				log.Warn("[streamFile] couldn't probe file, transcoding it", "error", err.Error(), "channel", c.Name())
+			} else {
+				direct = chooseDirectStream(info, profile, english)
+			}
+		}
+	}
 
-		// Map streams
-		"-map", "0:v:0",
-		"-map", audioMap,
+	for {
+		length := item.end.Sub(item.start) - offset
+
+		var inputArgs []string
+		if item.kind == kindOffAir {
+			inputArgs = testCardArgs(length)
+		} else {
+			var audioMap string
+			if english {
+				log.Debug("Mapping eng audio stream")
+				audioMap = "0:a:m:language:eng"
+			} else {
+				log.Debug("Mapping all audio streams")
+				audioMap = "0:a"
+			}
 
-		// Re-encode video to h.264 1920x1080
-		"-c:v", "libx264",
-		"-preset", "veryfast",
-		"-vf", "scale=1920:1080:force_original_aspect_ratio=decrease,pad=1920:1080:(ow-iw)/2:(oh-ih)/2", // letterbox 1080p
+			inputArgs = []string{
+				// Get input
+				// "-sseof", "-10", // start N seconds from the end
+				"-ss", strconv.FormatFloat((item.offset + offset).Seconds(), 'f', 3, 64), // seek to where the broadcast is at
+				"-t", strconv.FormatFloat(length.Seconds(), 'f', 3, 64), // stop when the item is cut short
+				"-re", // throttle to realtime
+				"-i", f.path,
+
+				// Map streams
+				"-map", "0:v:0",
+				"-map", audioMap,
+			}
 
-		// Re-encode audio to 48kHz stereo AAC
-		"-c:a", "aac",
-		"-ar", "48000",
-		"-ac", "2",
-		"-b:a", "128k",
+			switch item.kind {
+			case kindFiller, kindIdent, kindAd:
+				// The last clip before a program can be stretched a few
+				// seconds so the program starts on time, loop it rather
+				// than end early
+				inputArgs = append([]string{"-stream_loop", "-1"}, inputArgs...)
+			}
+		}
 
-		"-f", "mpegts", // format into mpegts so we can just dump it over http
-		"pipe:1", // use stdout so we can pipe it into our go program
-	}
+		ffmpegArgs := []string{
+			// Only errors on stderr, they say why a file failed
+			"-v", "error",
 
-	cmd := exec.Command("ffmpeg", ffmpegArgs...)
+			// Avoid timestamp funkiness
+			"-fflags", "+genpts",
+			"-avoid_negative_ts", "make_zero",
+		}
+		ffmpegArgs = append(ffmpegArgs, inputArgs...)
+		ffmpegArgs = append(ffmpegArgs, outputArgs(profile, direct)...)
+
+		dur := length.Round(time.Second).String()
+		if item.kind != kindOffAir {
+			var err error
+			if dur, err = f.DurationString(); err != nil {
+				log.Warn("[streamFile] couldn't get file duration", "error", err.Error(), "channel", c.Name())
+			}
+		}
+		log.Info("[streamFile] Running ffmpeg", "file", path.Base(f.path), "duration", dur, "offset", offset.Round(time.Second), "copyVideo", direct.video, "copyAudio", direct.audio, "channel", c.Name())
 
-	dur, err := f.DurationString()
-	if err != nil {
-		log.Warn("[streamFile] couldn't get file duration", "error", err.Error(), "channel", c.Name())
+		started := time.Now()
+		skipped, written, stderr, waitErr := c.runFFmpeg(ffmpegArgs, ctx, onOutput)
+
+		// ffmpeg was killed on purpose, that says nothing about the file
+		if skipped || ctx.Err() != nil {
+			return skipped, nil
+		}
+
+		played := time.Since(started)
+		reason := playbackFailure(waitErr, written, played, length, stderr)
+		if reason != "" && direct != (directStream{}) {
+			// Streams that looked fine to copy can still trip up the muxer,
+			// that's not the file's fault. Play the rest of it re-encoded
+			// instead, it's only failed if that fails too.
+			if length-played <= earlyEndSlack {
+				return false, errors.New(reason)
+			}
+
+			log.Warn("[streamFile] copying streams failed, transcoding instead", "reason", reason, "channel", c.Name())
+			direct = directStream{}
+			offset += played
+			continue
+		}
+
+		switch {
+		case item.kind == kindOffAir:
+			// The test card isn't a file at all
+		case reason != "":
+			c.recordFailure(ctx, f.path, reason, stderr)
+		default:
+			failures.played(f.path)
+		}
+
+		if reason != "" {
+			return false, errors.New(reason)
+		}
+		return false, nil
 	}
-	log.Info("[streamFile] Running ffmpeg", "file", path.Base(f.path), "duration", dur, "channel", c.Name())
+}
+
+// runFFmpeg runs ffmpeg with args, publishing what it outputs to all
+// connections until it ends, the context is canceled or a skip is requested.
+// Returns whether it was skipped, how many bytes it produced, the end of what
+// it reported on stderr and what waiting for it returned.
+func (c *Channel) runFFmpeg(args []string, ctx context.Context, onOutput func()) (bool, int, string, error) {
+	cmd := exec.Command("ffmpeg", args...)
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		log.Fatal("[streamFile] could not create stdout pipe", "error", err.Error(), "channel", c.Name())
 	}
 
-	// TODO: Figure out how to get output from stderr for debugging without blocking
-	// stderr, err := cmd.StderrPipe()
-	// if err != nil {
-	// 	log.Fatal(err.Error())
-	// }
+	// Keep the end of stderr to tell why a file failed, without blocking ffmpeg
+	stderr := &tailBuffer{max: 4096}
+	cmd.Stderr = stderr
 
 	if err := cmd.Start(); err != nil {
 		log.Fatal("[streamFile] could not run ffmpeg command", "error", err.Error(), "channel", c.Name())
 	}
+	written := 0
 
-	streamDone := make(chan struct{})
+	streamDone := make(chan bool)
 
 	go func() {
 		buf := make([]byte, 4096)
+		skipped := false
 
 	streamloop:
 		for {
@@ -293,24 +501,17 @@ func (c *Channel) streamFile(f mediafile, ctx context.Context) {
 				// kill ffmpeg so it'll pick up the next file
 				log.Debug("[streamFile] skip request received, killing ffmpeg and returning", "channel", c.Name(), "stopRequest", skipRequest.String())
 				cmd.Process.Kill()
+				skipped = true
 				break streamloop
 			default:
 				n, err := stdout.Read(buf)
 				if err != nil {
 					log.Info("[streamFile] ffmpeg ended:", "reason", err, "channel", c.Name())
-					// log.Debug(cmd.String())
-
-					// for {
-					// 	n, err := stderr.Read(buf)
-					// 	log.Debug("Stderr:", "contents", string(buf[:n]))
-					// 	if err != nil {
-					// 		log.Debug("Error reading stderr:", "error", err.Error())
-					// 		break
-					// 	}
-					// }
 					break streamloop
 				}
 				if n > 0 {
+					written += n
+					onOutput()
 					data := make([]byte, n)
 					copy(data, buf[:n])
 					c.connections.broadcast(data)
@@ -318,10 +519,13 @@ func (c *Channel) streamFile(f mediafile, ctx context.Context) {
 			}
 		}
 
-		streamDone <- struct{}{}
+		streamDone <- skipped
 	}()
 
 	log.Debug("[streamFile] waiting for streamDone signal", "channel", c.Name())
-	<-streamDone
+	skipped := <-streamDone
+	waitErr := cmd.Wait()
 	log.Debug("[streamFile] received streamDone signal, end of streamFile", "channel", c.Name())
+
+	return skipped, written, stderr.String(), waitErr
 }
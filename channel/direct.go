@@ -0,0 +1,115 @@
+package channel
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"video-stream/config"
+)
+
+// directStream says which of a file's streams go out as they are instead of
+// being re-encoded
+type directStream struct {
+	video bool
+	audio bool
+}
+
+// chooseDirectStream works out which of a file's streams already come out the
+// way the profile wants them, going by what ffprobe found. english is whether
+// only the file's English audio is played.
+func chooseDirectStream(info *mediaInfo, p config.Profile, english bool) directStream {
+	if !p.DirectStream {
+		return directStream{}
+	}
+
+	return directStream{
+		video: videoFits(info, p),
+		audio: audioFits(info, p, english),
+	}
+}
+
+// videoFits reports whether the video that's played, the file's first video
+// stream, can be sent as it is. It has to be the same size as everything else
+// on the channel, and something every client can play.
+func videoFits(info *mediaInfo, p config.Profile) bool {
+	if len(info.Video) == 0 {
+		return false
+	}
+	v := info.Video[0]
+
+	switch {
+	case v.Codec != encoderCodec(p.VideoCodec):
+		return false
+	case v.Width != p.Width || v.Height != p.Height:
+		return false
+	case v.FieldOrder != "" && v.FieldOrder != "progressive":
+		return false
+	case v.PixFmt != "yuv420p":
+		return false
+	case p.FrameRate != "" && math.Abs(v.FrameRate-frameRate(p.FrameRate)) > 0.01:
+		return false
+	case p.VideoBitrate != "" && (info.BitRate == 0 || info.BitRate > parseBitrate(p.VideoBitrate)):
+		return false // too much for the clients, or no telling
+	}
+
+	return true
+}
+
+// audioFits reports whether every audio stream that's played can be sent as it
+// is
+func audioFits(info *mediaInfo, p config.Profile, english bool) bool {
+	played := 0
+	for _, a := range info.Audio {
+		if english && a.Language != "eng" {
+			continue
+		}
+		played++
+
+		if a.Codec != encoderCodec(p.AudioCodec) || a.Channels != p.AudioChannels || a.SampleRate != p.SampleRate {
+			return false
+		}
+	}
+
+	return played > 0
+}
+
+// Codecs of ffmpeg's encoders that aren't named after them
+var encoderCodecs = map[string]string{
+	"libx264":    "h264",
+	"libx265":    "hevc",
+	"libfdk_aac": "aac",
+	"libmp3lame": "mp3",
+	"libopus":    "opus",
+	"libvorbis":  "vorbis",
+}
+
+// encoderCodec returns the codec an ffmpeg encoder produces, as ffprobe names
+// it. Hardware encoders are named after theirs, e.g. h264_nvenc.
+func encoderCodec(encoder string) string {
+	if codec, ok := encoderCodecs[encoder]; ok {
+		return codec
+	}
+
+	codec, _, _ := strings.Cut(encoder, "_")
+	return codec
+}
+
+// parseBitrate parses a bitrate like ffmpeg takes them, e.g. 8M or 3000k, into
+// bits per second
+func parseBitrate(s string) int {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(s, "M"):
+		multiplier, s = 1000000, strings.TrimSuffix(s, "M")
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		multiplier, s = 1000, s[:len(s)-1]
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+
+	return int(f * float64(multiplier))
+}
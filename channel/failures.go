@@ -0,0 +1,337 @@
+package channel
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"video-stream/config"
+	"video-stream/log"
+)
+
+var ErrNotQuarantined = errors.New("file is not quarantined")
+
+// QuarantinedFile is a file that kept failing to play, so it's been taken out
+// of every library until it changes or is released
+type QuarantinedFile struct {
+	Path     string    `json:"path"`
+	Failures int       `json:"failures"`
+	Reason   string    `json:"reason"` // why it failed last
+	Since    time.Time `json:"since"`
+}
+
+// Quarantined returns the files that are quarantined, most recent first
+func Quarantined() []QuarantinedFile {
+	return failures.quarantined()
+}
+
+// Release puts a quarantined file back in the libraries it's in, from the next
+// rescan on
+func Release(filePath string) error {
+	return failures.release(filePath)
+}
+
+// failureTracker remembers which files failed to play, and how often, so broken
+// files stop coming back. Like the metadata cache, records are for a file's
+// size and modification time, a file that's been replaced gets a fresh start.
+type failureTracker struct {
+	mu      sync.Mutex
+	once    sync.Once
+	path    string
+	entries map[string]failureRecord // file path -> record
+}
+
+type failureRecord struct {
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"modTime"`
+	Failures    int       `json:"failures"` // in a row
+	Reason      string    `json:"reason"`
+	LastFailed  time.Time `json:"lastFailed"`
+	Quarantined bool      `json:"quarantined"`
+}
+
+var failures = &failureTracker{}
+
+// load reads the failures from disk the first time they're needed
+func (ft *failureTracker) load() {
+	ft.once.Do(func() {
+		ft.path = path.Join(config.Current.StateDir, "failures.json")
+		ft.entries = make(map[string]failureRecord)
+
+		data, err := os.ReadFile(ft.path)
+		if errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		if err == nil {
+			err = json.Unmarshal(data, &ft.entries)
+		}
+		if err != nil {
+			log.Warn("could not load failed files, starting from scratch", "path", ft.path, "error", err.Error())
+			ft.entries = make(map[string]failureRecord)
+		}
+	})
+}
+
+// failed records that the file at p failed to play, and quarantines it once it
+// has failed too many times in a row. Returns whether it's quarantined now.
+func (ft *failureTracker) failed(p string, reason string) bool {
+	stat, err := os.Stat(p)
+	if err != nil {
+		log.Debug("could not record failure, file is gone", "path", p, "error", err.Error())
+		return false
+	}
+
+	ft.load()
+	ft.mu.Lock()
+	rec, ok := ft.entries[p]
+	if !ok || !rec.matches(stat) {
+		rec = failureRecord{Size: stat.Size(), ModTime: stat.ModTime()}
+	}
+	rec.Failures++
+	rec.Reason = reason
+	rec.LastFailed = time.Now()
+	newly := !rec.Quarantined && rec.Failures >= config.Current.Library.QuarantineAfter
+	rec.Quarantined = rec.Quarantined || newly
+	ft.entries[p] = rec
+	ft.mu.Unlock()
+
+	if newly {
+		log.Warn("quarantined file", "path", p, "failures", rec.Failures, "reason", reason)
+	} else {
+		log.Warn("file failed to play", "path", p, "failures", rec.Failures, "reason", reason)
+	}
+
+	ft.saveOrWarn()
+	return newly
+}
+
+// played records that the file at p played fine, so earlier failures are
+// forgotten
+func (ft *failureTracker) played(p string) {
+	ft.load()
+	ft.mu.Lock()
+	_, ok := ft.entries[p]
+	delete(ft.entries, p)
+	ft.mu.Unlock()
+
+	if ok {
+		ft.saveOrWarn()
+	}
+}
+
+// isQuarantined reports whether the file at p is quarantined and hasn't
+// changed since
+func (ft *failureTracker) isQuarantined(p string) bool {
+	ft.load()
+	ft.mu.Lock()
+	rec, ok := ft.entries[p]
+	ft.mu.Unlock()
+	if !ok || !rec.Quarantined {
+		return false
+	}
+
+	stat, err := os.Stat(p)
+	return err == nil && rec.matches(stat)
+}
+
+func (ft *failureTracker) quarantined() []QuarantinedFile {
+	ft.load()
+	ft.mu.Lock()
+	out := []QuarantinedFile{}
+	for p, rec := range ft.entries {
+		if rec.Quarantined {
+			out = append(out, QuarantinedFile{Path: p, Failures: rec.Failures, Reason: rec.Reason, Since: rec.LastFailed})
+		}
+	}
+	ft.mu.Unlock()
+
+	slices.SortFunc(out, func(a, b QuarantinedFile) int {
+		return cmp.Or(b.Since.Compare(a.Since), cmp.Compare(a.Path, b.Path))
+	})
+	return out
+}
+
+func (ft *failureTracker) release(p string) error {
+	ft.load()
+	ft.mu.Lock()
+	rec, ok := ft.entries[p]
+	if ok && rec.Quarantined {
+		delete(ft.entries, p)
+	}
+	ft.mu.Unlock()
+
+	if !ok || !rec.Quarantined {
+		return ErrNotQuarantined
+	}
+
+	log.Info("released file from quarantine", "path", p)
+	ft.saveOrWarn()
+	return nil
+}
+
+func (rec failureRecord) matches(stat os.FileInfo) bool {
+	return rec.Size == stat.Size() && rec.ModTime.Equal(stat.ModTime())
+}
+
+func (ft *failureTracker) saveOrWarn() {
+	if err := ft.save(); err != nil {
+		log.Warn("could not save failed files", "path", ft.path, "error", err.Error())
+	}
+}
+
+func (ft *failureTracker) save() error {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	data, err := json.Marshal(ft.entries)
+	if err != nil {
+		return fmt.Errorf("could not marshal failed files: %w", err)
+	}
+
+	if err := writeFileAtomic(ft.path, data); err != nil {
+		return fmt.Errorf("could not write failed files: %w", err)
+	}
+
+	return nil
+}
+
+// How much earlier than scheduled ffmpeg can finish before errors it reported
+// count as the file failing, and the schedule is moved up to match
+const earlyEndSlack = 5 * time.Second
+
+// How long the player waits after something fails to play before moving on,
+// doubling every time in a row up to the most, so a channel that can't play
+// anything doesn't spin through its schedule
+const (
+	failureBackoff    = time.Second
+	maxFailureBackoff = 30 * time.Second
+)
+
+// playbackFailure says why playing a file failed, or returns "" if it didn't.
+// waitErr is what waiting for ffmpeg returned, written how many bytes it
+// produced, played how long it ran for out of length, and stderr what it
+// reported at the error log level.
+func playbackFailure(waitErr error, written int, played time.Duration, length time.Duration, stderr string) string {
+	last := lastLine(stderr)
+
+	switch {
+	case waitErr != nil:
+		return strings.TrimSuffix("ffmpeg failed: "+waitErr.Error()+": "+last, ": ")
+	case written == 0:
+		return strings.TrimSuffix("ffmpeg produced no output: "+last, ": ")
+	case last != "" && played < length-earlyEndSlack:
+		return "ffmpeg stopped early: " + last
+	}
+
+	return ""
+}
+
+// Things ffmpeg says when it's the file being played that's broken, rather
+// than anything on the output side
+var inputErrors = []string{
+	"error opening input",
+	"error demuxing input",
+	"error during demuxing",
+	"invalid data found when processing input",
+	"moov atom not found",
+	"ebml header parsing failed",
+	"error while decoding",
+	"decoding error",
+}
+
+// Prefixes of ffmpeg's messages about the output side, the encoders and muxer.
+// Their errors can read like input errors, e.g. an encoder rejecting a frame
+// with "invalid data".
+var outputPrefixes = []string{"[vost#", "[aost#", "[out#", "[enc:", "[mux"}
+
+// inputError returns the last line of ffmpeg's stderr that says the file at
+// input is broken, or "" if none of them do
+func inputError(stderr string, input string) string {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	for _, line := range slices.Backward(lines) {
+		line = strings.TrimSpace(line)
+		lower := strings.ToLower(line)
+
+		if slices.ContainsFunc(outputPrefixes, func(p string) bool { return strings.HasPrefix(lower, p) }) {
+			continue
+		}
+		if strings.HasPrefix(line, input+":") || strings.HasPrefix(lower, "[in#0") ||
+			strings.HasPrefix(lower, "[vist#0:") || strings.HasPrefix(lower, "[aist#0:") ||
+			slices.ContainsFunc(inputErrors, func(e string) bool { return strings.Contains(lower, e) }) {
+			return line
+		}
+	}
+
+	return ""
+}
+
+// checkOutput encodes a second of the test card the way the profile says,
+// returning why that failed if it did. If the test card won't play either, a
+// file failing says nothing about the file.
+func checkOutput(ctx context.Context, p config.Profile) error {
+	args := append([]string{"-v", "error"}, testCardArgs(time.Second)...)
+	args = append(args, outputArgs(p, directStream{})...)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	stderr := &tailBuffer{max: 4096}
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("test card failed: %w: %s", err, lastLine(stderr.String()))
+	}
+
+	return nil
+}
+
+// recordFailure counts a file failing to play against it, if it's the file's
+// fault. reason is why playback failed and stderr what ffmpeg reported.
+func (c *Channel) recordFailure(ctx context.Context, filePath string, reason string, stderr string) {
+	blame := inputError(stderr, filePath)
+	if blame == "" {
+		log.Warn("[streamFile] ffmpeg failed, but not because of the file", "file", filePath, "reason", reason, "channel", c.Name())
+		return
+	}
+
+	if err := checkOutput(ctx, c.schedule.cfg.Transcode); err != nil {
+		log.Warn("[streamFile] ffmpeg failed, but the test card won't play either", "file", filePath, "reason", reason, "error", err.Error(), "channel", c.Name())
+		return
+	}
+
+	if failures.failed(filePath, blame) {
+		// Take it off the schedule now rather than at the next rescan
+		go c.schedule.rescan()
+	}
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// tailBuffer keeps the last max bytes written to it, for ffmpeg's stderr
+type tailBuffer struct {
+	buf []byte
+	max int
+}
+
+func (tb *tailBuffer) Write(p []byte) (int, error) {
+	tb.buf = append(tb.buf, p...)
+	if len(tb.buf) > tb.max {
+		tb.buf = tb.buf[len(tb.buf)-tb.max:]
+	}
+
+	return len(p), nil
+}
+
+func (tb *tailBuffer) String() string {
+	return string(tb.buf)
+}
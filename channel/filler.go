@@ -0,0 +1,153 @@
+package channel
+
+import (
+	"math/rand"
+	"time"
+)
+
+type itemKind int
+
+const (
+	kindProgram itemKind = iota
+	kindFiller           // bumpers and padding between programs
+	kindIdent            // station idents
+	kindAd               // commercials during programs
+	kindSignOn           // played when the channel comes on air
+	kindSignOff          // played before the channel goes off air
+	kindOffAir           // test card while the channel is off air
+)
+
+var itemKindName = map[itemKind]string{
+	kindProgram: "program",
+	kindFiller:  "filler",
+	kindIdent:   "ident",
+	kindAd:      "ad",
+	kindSignOn:  "signon",
+	kindSignOff: "signoff",
+	kindOffAir:  "offair",
+}
+
+func (k itemKind) String() string {
+	return itemKindName[k]
+}
+
+// parseItemKind is the reverse of itemKind.String, unknown names are programs
+func parseItemKind(name string) itemKind {
+	for k, n := range itemKindName {
+		if n == name {
+			return k
+		}
+	}
+
+	return kindProgram
+}
+
+// findClips finds the filler or ident clips in dirs. Clips aren't organised by
+// show, so they all go in one list.
+func findClips(dirs []string, what string, warn func(string, ...any)) []*mediafile {
+	found, errs := findMedia(dirs)
+	logScanErrors(warn, errs, what)
+
+	clips := []*mediafile{}
+	for _, files := range found {
+		clips = append(clips, files...)
+	}
+
+	return clips
+}
+
+// clip schedules a random clip from clips at start
+func (s *schedule) clip(clips []*mediafile, kind itemKind, start time.Time) scheduleItem {
+	si := s.newItem(clips[rand.Intn(len(clips))], start)
+	si.kind = kind
+	return si
+}
+
+// breakAfter schedules what goes between a program ending at start and the
+// next one: an ident if one is due, then either filler up to the next padding
+// boundary or a single bumper. Nothing in the break runs into a fixed slot.
+// The caller must hold s.genMu.
+func (s *schedule) breakAfter(start time.Time) []scheduleItem {
+	items := []scheduleItem{}
+
+	until := time.Time{}
+	if deadline, _, ok := s.nextDeadline(start); ok {
+		until = deadline
+	}
+	fits := func(si scheduleItem) bool {
+		return until.IsZero() || !si.end.After(until)
+	}
+
+	s.mu.Lock()
+	identDue := len(s.idents) > 0 && s.cfg.IdentInterval > 0 && start.Sub(s.lastIdent) >= s.cfg.IdentInterval
+	s.mu.Unlock()
+
+	if identDue {
+		if si := s.clip(s.idents, kindIdent, start); fits(si) {
+			s.record(si)
+			items = append(items, si)
+			start = si.end
+		}
+	}
+
+	switch {
+	case s.cfg.PadTo > 0:
+		if boundary := nextBoundary(start, s.cfg.PadTo); until.IsZero() || boundary.Before(until) {
+			until = boundary
+		}
+		items = append(items, s.pad(start, until)...)
+	case len(s.filler) > 0:
+		if si := s.clip(s.filler, kindFiller, start); fits(si) {
+			items = append(items, si)
+		}
+	}
+
+	return items
+}
+
+// pad fills the time from start until until with filler clips, preferring ones
+// that fit and cutting the last one short if needed. Returns nothing if the
+// channel doesn't have any filler. until must be set.
+func (s *schedule) pad(start time.Time, until time.Time) []scheduleItem {
+	return s.padWith(s.filler, kindFiller, start, until)
+}
+
+// padWith fills the time from start until until with clips of the given kind
+func (s *schedule) padWith(clips []*mediafile, kind itemKind, start time.Time, until time.Time) []scheduleItem {
+	items := []scheduleItem{}
+
+	for len(clips) > 0 && until.Sub(start) >= minFillGap {
+		si := s.clip(clips, kind, start)
+		for range fillAttempts {
+			if !si.end.After(until) {
+				break
+			}
+			si = s.clip(clips, kind, start)
+		}
+
+		if si.end.After(until) {
+			si.end = until
+		}
+
+		items = append(items, si)
+		start = si.end
+	}
+
+	// Whatever's left is too short to fill, stretch the last clip so the next
+	// program is listed as starting right on time
+	if len(items) > 0 {
+		items[len(items)-1].end = until
+	}
+
+	return items
+}
+
+// nextBoundary returns the first multiple of every, counting from midnight,
+// at or after t. With every set to 30 minutes that's the next :00 or :30.
+func nextBoundary(t time.Time, every time.Duration) time.Time {
+	y, m, d := t.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+
+	n := (t.Sub(midnight) + every - 1) / every
+	return midnight.Add(n * every)
+}
@@ -0,0 +1,86 @@
+package channel
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrNoArtwork = errors.New("item has no artwork")
+
+// Programme is a single entry in a channel's programme guide
+type Programme struct {
+	ID           uint64 // of the schedule item the programme starts with
+	Title        string // name of the show
+	EpisodeTitle string
+	Season       int // zero if unknown
+	Episode      int // zero if unknown
+	Description  string
+	HasArtwork   bool // whether Artwork has something for ID
+	Start        time.Time
+	End          time.Time
+}
+
+// Guide returns everything currently scheduled on the channel, starting with
+// what's on air right now. Filler, idents and ads don't get their own entries,
+// the programme before them runs on until the next one starts. Nothing is
+// listed while the channel is off air.
+func (c *Channel) Guide() []Programme {
+	items := c.schedule.items()
+	out := make([]Programme, 0, len(items))
+	extend := false // whether there's a programme for in-between items to extend
+
+	for _, si := range items {
+		mf := si.mediafile
+
+		if si.kind == kindOffAir {
+			extend = false
+			continue
+		}
+
+		// Later segments of a program split by commercial breaks are part of
+		// the same entry too
+		if si.kind != kindProgram || (si.offset > 0 && extend) {
+			if extend {
+				out[len(out)-1].End = si.end
+			}
+			continue
+		}
+
+		// Don't put file paths in the guide
+		episodeTitle := mf.name
+		if episodeTitle == mf.path {
+			episodeTitle = ""
+		}
+
+		out = append(out, Programme{
+			ID:           si.id,
+			Title:        mf.ShowTitle(),
+			EpisodeTitle: episodeTitle,
+			Season:       mf.season,
+			Episode:      mf.episode,
+			Description:  mf.description,
+			HasArtwork:   mf.artwork != "",
+			Start:        si.start,
+			End:          si.end,
+		})
+		extend = true
+	}
+
+	return out
+}
+
+// Artwork returns the path of the thumbnail or poster for the scheduled item
+// with the given ID, or for whatever's on air if id is zero.
+func (c *Channel) Artwork(id uint64) (string, error) {
+	now := time.Now()
+	for _, si := range c.schedule.items() {
+		if (id == 0 && !si.start.After(now) && si.end.After(now)) || (id != 0 && si.id == id) {
+			if si.mediafile.artwork == "" {
+				return "", ErrNoArtwork
+			}
+			return si.mediafile.artwork, nil
+		}
+	}
+
+	return "", ErrNoSuchItem
+}
@@ -0,0 +1,228 @@
+package channel
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	"video-stream/config"
+	"video-stream/log"
+)
+
+// library is everything a channel can play, found by scanning its directories
+type library struct {
+	media      map[string][]*mediafile // show name -> episodes
+	shows      []string                // shows from the channel's directories
+	blockShows [][]string              // shows for each of cfg.Blocks
+	overShows  [][]string              // shows for each of cfg.Overrides
+	slots      []config.Slot           // fixed slots for shows that are in the library
+	filler     []*mediafile
+	idents     []*mediafile
+	ads        []*mediafile
+}
+
+// scanLibrary scans all of a channel's directories. Anything that goes wrong
+// is reported with warn, directories that can't be scanned completely still
+// give whatever could be found in them.
+func scanLibrary(cfg config.Channel, warn func(string, ...any)) library {
+	media, errs := findMedia(cfg.Directories)
+	logScanErrors(warn, errs, "media")
+
+	lib := library{
+		media:      media,
+		shows:      slices.Collect(maps.Keys(media)),
+		blockShows: make([][]string, len(cfg.Blocks)),
+		overShows:  make([][]string, len(cfg.Overrides)),
+	}
+
+	// Blocks and overrides play from their own directories, which are part of
+	// the library alongside the channel's own
+	for i, b := range cfg.Blocks {
+		lib.blockShows[i] = addToLibrary(media, b.Directories, warn)
+		if len(lib.blockShows[i]) == 0 && len(b.Directories) > 0 {
+			warn("could not find media for block, using the channel's directories instead", "block", b.Start.String()+"-"+b.End.String())
+		}
+	}
+
+	for i, o := range cfg.Overrides {
+		lib.overShows[i] = addToLibrary(media, o.Directories, warn)
+		if len(lib.overShows[i]) == 0 && len(o.Directories) > 0 {
+			warn("could not find media for override, ignoring its directories", "override", o.Name)
+		}
+	}
+
+	// Slots for shows that aren't in the library can never be filled
+	lib.slots = slices.DeleteFunc(slices.Clone(cfg.Slots), func(slot config.Slot) bool {
+		if _, ok := media[slot.Show]; !ok {
+			warn("show for fixed slot isn't in the channel's library, ignoring it", "show", slot.Show)
+			return true
+		}
+		return false
+	})
+
+	lib.filler = findClips(cfg.Filler, "filler", warn)
+	lib.idents = findClips(cfg.Idents, "idents", warn)
+	lib.ads = findClips(cfg.Ads, "ads", warn)
+
+	return lib
+}
+
+// paths returns every file in the library, by path
+func (lib library) paths() map[string]*mediafile {
+	out := make(map[string]*mediafile)
+	for _, files := range lib.media {
+		for _, mf := range files {
+			out[mf.path] = mf
+		}
+	}
+	for _, clips := range [][]*mediafile{lib.filler, lib.idents, lib.ads} {
+		for _, mf := range clips {
+			out[mf.path] = mf
+		}
+	}
+
+	return out
+}
+
+// watch rescans the channel's directories every so often until ctx is
+// canceled, so files added while the channel is running get scheduled and
+// deleted ones don't. New files are probed in the background. name is the
+// channel's, for the logs.
+func (s *schedule) watch(ctx context.Context, name string) {
+	ticker := time.NewTicker(config.Current.Library.RescanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if s.rescan() {
+				go s.probeAll(ctx, name)
+			}
+		}
+	}
+}
+
+// rescan brings the library up to date with what's on disk. Files that were
+// already known keep their metadata, and anything scheduled that's no longer
+// there is taken off the schedule. Returns whether anything changed.
+func (s *schedule) rescan() bool {
+	// Scanning can take a while on big libraries, do it without holding up
+	// the generator. Problems were already reported on the first scan.
+	lib := scanLibrary(s.cfg, log.Debug)
+
+	s.genMu.Lock()
+	defer s.genMu.Unlock()
+
+	old := s.library.paths()
+	now := lib.paths()
+
+	added, removed := 0, 0
+	for p := range now {
+		if _, ok := old[p]; !ok {
+			added++
+		}
+	}
+	for p := range old {
+		if _, ok := now[p]; !ok {
+			removed++
+		}
+	}
+	if added == 0 && removed == 0 {
+		return false
+	}
+
+	// Shows that haven't changed keep their files as they are, already in
+	// order. Changed ones have to be put in order again.
+	s.mu.Lock()
+	for show, files := range lib.media {
+		same := len(files) == len(s.media[show]) && !slices.ContainsFunc(files, func(mf *mediafile) bool {
+			_, ok := old[mf.path]
+			return !ok
+		})
+		if same {
+			lib.media[show] = s.media[show]
+			continue
+		}
+
+		for i, mf := range files {
+			if known, ok := old[mf.path]; ok {
+				files[i] = known
+			}
+		}
+		s.sorted[show] = false
+	}
+	for _, clips := range [][]*mediafile{lib.filler, lib.idents, lib.ads} {
+		for i, mf := range clips {
+			if known, ok := old[mf.path]; ok {
+				clips[i] = known
+			}
+		}
+	}
+
+	s.library = lib
+	dropped, gaps := s.dropMissing(now)
+	s.mu.Unlock()
+	s.fillGaps(gaps)
+
+	log.Info("[schedule] library changed", "added", added, "removed", removed, "unscheduled", dropped)
+	go s.refreshCatalog()
+	if dropped > 0 {
+		s.saveOrWarn()
+	}
+	return true
+}
+
+// dropMissing takes everything that's coming up but isn't in the library any
+// more off the schedule, along with the breaks and other segments that go with
+// it, returning how many items were taken off. Everything else stays where it
+// is, the gaps left behind are returned to be filled with fillGaps. The item
+// on air is left alone, ffmpeg already has it open.
+// The caller must hold s.mu.
+func (s *schedule) dropMissing(present map[string]*mediafile) (int, []gap) {
+	first := s.upNext(time.Now())
+	kept := s.scheduled[:first]
+	dropped := 0
+	gaps := []gap{}
+
+	for i := first; i < len(s.scheduled); {
+		_, to := s.group(i)
+		group := s.scheduled[i:to]
+		i = to
+
+		missing := slices.ContainsFunc(group, func(si scheduleItem) bool {
+			switch si.kind {
+			case kindOffAir, kindSignOn, kindSignOff:
+				return false // not from the library
+			}
+			_, ok := present[si.mediafile.path]
+			return !ok
+		})
+		if missing {
+			dropped += len(group)
+			start, end := group[0].start, group[len(group)-1].end
+			if n := len(gaps); n > 0 && gaps[n-1].end.Equal(start) {
+				gaps[n-1].end = end
+			} else {
+				gaps = append(gaps, gap{start: start, end: end})
+			}
+			continue
+		}
+
+		kept = append(kept, group...)
+	}
+
+	// The generator carries on from the last item, there's nothing to fill
+	// after it
+	if n := len(gaps); n > 0 && (len(kept) == 0 || !gaps[n-1].start.Before(kept[len(kept)-1].end)) {
+		gaps = gaps[:n-1]
+	}
+
+	if dropped > 0 {
+		s.scheduled = kept
+	}
+
+	return dropped, gaps
+}
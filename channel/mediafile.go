@@ -1,26 +1,29 @@
 package channel
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"os/exec"
+	"path"
+	"regexp"
 	"strconv"
-	"strings"
 	"time"
 
 	"video-stream/log"
 )
 
-// TODO: Get all metadata once with ffprobe, parse JSON instead of having
-// 3 different methods and CSV parsing and stuff.
-
 type mediafile struct {
-	name      string
-	show      string
-	path      string
-	duration  time.Duration
-	languages map[int]string
+	name        string
+	show        string
+	path        string
+	duration    time.Duration
+	languages   map[int]string
+	showTitle   string // show name from the file's tags, show is the library key
+	season      int
+	episode     int
+	dirSeason   int // from the "Season N" folder the file is in, if it's in one
+	description string
+	chapters    []time.Duration // start times of the file's chapters
+	artwork     string          // path of a thumbnail or poster, empty if there's none
+	info        *mediaInfo      // everything ffprobe found, once metadata is loaded
 }
 
 func (mf *mediafile) Name() string {
@@ -37,52 +40,86 @@ func (mf *mediafile) ShowName() string {
 	return mf.show
 }
 
-// TODO: Do this for all metadata fields at once
+// ShowTitle returns the show name from the file's metadata, falling back to
+// the name of the show in the library.
+func (mf *mediafile) ShowTitle() string {
+	if mf.showTitle != "" {
+		return mf.showTitle
+	}
+
+	return mf.show
+}
+
+// LoadMetadata fills in the file's details from its tags, using the metadata
+// cache when the file hasn't changed since it was last probed
 func (mf *mediafile) LoadMetadata() error {
-	cmd := exec.Command(
-		"ffprobe",
-		"-i", mf.path,
-		"-show_entries", "stream=index:stream_tags=language:format_tags=title,show,season_number,episode_sort:format=duration",
-		"-v", "quiet",
-		"-of", "json",
-	)
-
-	out, err := cmd.Output()
+	info, err := cachedProbe(mf.path)
 	if err != nil {
-		return fmt.Errorf("ffprobe failed: %w", err)
+		return err
 	}
 
-	var result struct {
-		Format struct {
-			Duration string `json:"duration"`
-			Tags     struct {
-				Title   string `json:"title"`
-				Show    string `json:"show"`
-				Season  string `json:"season_number"`
-				Episode string `json:"episode_sort"`
-			} `json:"tags"`
-		} `json:"format"`
+	log.Debug("ffprobe result", "file", mf.path, "info", fmt.Sprintf("%+v", *info))
+	mf.setInfo(info)
+
+	return nil
+}
+
+// setInfo fills in the file's details from what ffprobe found, and from its
+// sidecars
+func (mf *mediafile) setInfo(info *mediaInfo) {
+	tags := info.Tags
+	mf.name = tags["title"]
+	mf.showTitle = tags["show"]
+	mf.season, _ = strconv.Atoi(tags["season_number"])
+	mf.episode, _ = strconv.Atoi(tags["episode_sort"])
+
+	// Different taggers put the plot in different places
+	switch {
+	case tags["description"] != "":
+		mf.description = tags["description"]
+	case tags["synopsis"] != "":
+		mf.description = tags["synopsis"]
+	default:
+		mf.description = tags["comment"]
 	}
 
-	if err := json.Unmarshal(out, &result); err != nil {
-		return fmt.Errorf("failed to parse ffprobe output: %w", err)
+	// Fill in whatever the tags don't say
+	mf.loadSidecars()
+	if mf.name == "" {
+		mf.name = mf.path
 	}
 
-	pretty, _ := json.MarshalIndent(result, "", "  ")
-	log.Info("ffprobe result", "pretty", string(pretty))
+	mf.info = info
+	mf.duration = info.Duration
+	mf.chapters = info.ChapterStarts()
+	mf.languages = info.Languages()
+}
 
-	// Deal with missing metadata
-	if (result.Format.Tags.Title != "") {
-		mf.name = result.Format.Tags.Title
-	} else {
-		mf.name = mf.path
+// Info returns everything ffprobe has to say about the file
+func (mf *mediafile) Info() (*mediaInfo, error) {
+	if mf.info == nil {
+		if err := mf.LoadMetadata(); err != nil {
+			return nil, err
+		}
 	}
 
-	if duration, err := strconv.ParseFloat(result.Format.Duration, 64); err == nil {
-		mf.duration = time.Duration(duration * float64(time.Second))
+	return mf.info, nil
+}
+
+// Matches S01E02, s1e2, S01.E02 and the like
+var episodePattern = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])s(\d{1,3})[ ._-]?e(\d{1,4})`)
+
+// episodeFromFilename parses season and episode numbers out of a file name,
+// for files that don't have them in their tags.
+func episodeFromFilename(p string) (season int, episode int, ok bool) {
+	m := episodePattern.FindStringSubmatch(path.Base(p))
+	if m == nil {
+		return crossEpisode(path.Base(p))
 	}
 
-	return nil
+	season, _ = strconv.Atoi(m[1])
+	episode, _ = strconv.Atoi(m[2])
+	return season, episode, true
 }
 
 func (mf *mediafile) Duration() (time.Duration, error) {
@@ -90,26 +127,16 @@ func (mf *mediafile) Duration() (time.Duration, error) {
 		log.Debug("Using cached duration")
 		return mf.duration, nil
 	}
-	cmd := exec.Command(
-		"ffprobe",
-		"-i", mf.path,
-		"-show_entries", "format=duration",
-		"-v", "quiet",
-		"-of", "csv=p=0",
-	)
-
-	out, err := cmd.Output()
+	info, err := cachedProbe(mf.path)
 	if err != nil {
 		return 0, fmt.Errorf("failed to run ffprobe: %w", err)
 	}
-
-	durationStr := strings.TrimSpace(string(out))
-	durationSec, err := strconv.ParseFloat(durationStr, 64)
-	if err != nil {
-		return 0, fmt.Errorf("failed to parse duration: %w", err)
+	if info.Duration == 0 {
+		return 0, fmt.Errorf("ffprobe found no duration for %s", mf.path)
 	}
 
-	mf.duration = time.Duration(durationSec * float64(time.Second))
+	mf.info = info
+	mf.duration = info.Duration
 	return mf.duration, nil
 }
 
@@ -132,45 +159,14 @@ func (mf *mediafile) Languages() (map[int]string, error) {
 		return mf.languages, nil
 	}
 
-	// Run ffprobe to extract audio stream indexes and language tags
-	cmd := exec.Command(
-		"ffprobe",
-		"-v", "error",
-		"-select_streams", "a",
-		"-show_entries", "stream=index:stream_tags=language",
-		"-of", "csv=p=0",
-		mf.path,
-	)
-
-	var out bytes.Buffer
-	cmd.Stdout = &out
-
-	if err := cmd.Run(); err != nil {
+	info, err := cachedProbe(mf.path)
+	if err != nil {
 		return nil, err
 	}
 
-	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
-	languages := make(map[int]string)
-
-	for _, line := range lines {
-		parts := strings.Split(line, ",")
-		if len(parts) == 2 {
-			// parts[0] = stream index, parts[1] = language
-			// (e.g., "1,eng")
-			idx := strings.TrimSpace(parts[0])
-			lang := strings.TrimSpace(parts[1])
-			if idx != "" && lang != "" {
-				// convert index string to int
-				var streamIdx int
-				fmt.Sscanf(idx, "%d", &streamIdx)
-				languages[streamIdx] = lang
-			}
-		}
-	}
-
-	mf.languages = languages
-
-	return languages, nil
+	mf.info = info
+	mf.languages = info.Languages()
+	return mf.languages, nil
 }
 
 func (mf *mediafile) hasEnglishAudio() bool {
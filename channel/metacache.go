@@ -0,0 +1,155 @@
+package channel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"video-stream/config"
+	"video-stream/log"
+)
+
+// Bumped whenever mediaInfo changes shape, so older caches get thrown away
+// instead of leaving out what's new
+const metadataCacheVersion = 2
+
+// How long to wait after a file is probed before writing the cache out, so a
+// library scan doesn't rewrite it for every file
+const metadataSaveDelay = 5 * time.Second
+
+// cachedProbe returns what ffprobe has to say about the file at p, from the
+// metadata cache if the file hasn't changed since it was last probed
+func cachedProbe(p string) (*mediaInfo, error) {
+	stat, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, ok := metadata.get(p, stat); ok {
+		return info, nil
+	}
+
+	info, err := probe(p)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata.put(p, stat, info)
+	return info, nil
+}
+
+// metadataCache keeps ffprobe results on disk, so files only get probed again
+// when they change
+type metadataCache struct {
+	mu      sync.Mutex
+	saveMu  sync.Mutex // one save at a time, they share a temporary file
+	once    sync.Once
+	path    string
+	entries map[string]cacheEntry // file path -> entry
+	pending bool                  // whether a save is coming up
+}
+
+// cacheFile is how the cache is written to disk
+type cacheFile struct {
+	Version int                   `json:"version"`
+	Files   map[string]cacheEntry `json:"files"`
+}
+
+type cacheEntry struct {
+	Size    int64      `json:"size"`
+	ModTime time.Time  `json:"modTime"`
+	Info    *mediaInfo `json:"info"`
+}
+
+var metadata = &metadataCache{}
+
+// load reads the cache from disk the first time it's needed, the config isn't
+// read yet when the package is initialised
+func (mc *metadataCache) load() {
+	mc.once.Do(func() {
+		mc.path = path.Join(config.Current.StateDir, "metadata.json")
+		mc.entries = make(map[string]cacheEntry)
+
+		data, err := os.ReadFile(mc.path)
+		if errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		var cf cacheFile
+		if err == nil {
+			err = json.Unmarshal(data, &cf)
+		}
+		if err != nil {
+			log.Warn("could not load metadata cache, probing files again", "path", mc.path, "error", err.Error())
+			return
+		}
+		if cf.Version != metadataCacheVersion {
+			log.Info("metadata cache is from an older version, probing files again", "path", mc.path)
+			return
+		}
+
+		if cf.Files != nil {
+			mc.entries = cf.Files
+		}
+		log.Info("loaded metadata cache", "path", mc.path, "files", len(mc.entries))
+	})
+}
+
+// get returns the cached info for the file at p, if the file's size and
+// modification time still match
+func (mc *metadataCache) get(p string, stat os.FileInfo) (*mediaInfo, bool) {
+	mc.load()
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	e, ok := mc.entries[p]
+	if !ok || e.Info == nil || e.Size != stat.Size() || !e.ModTime.Equal(stat.ModTime()) {
+		return nil, false
+	}
+
+	return e.Info, true
+}
+
+// put adds info for the file at p to the cache, and writes the cache out
+// shortly after
+func (mc *metadataCache) put(p string, stat os.FileInfo, info *mediaInfo) {
+	mc.load()
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.entries[p] = cacheEntry{Size: stat.Size(), ModTime: stat.ModTime(), Info: info}
+
+	if !mc.pending {
+		mc.pending = true
+		time.AfterFunc(metadataSaveDelay, func() {
+			if err := mc.save(); err != nil {
+				log.Warn("could not save metadata cache", "path", mc.path, "error", err.Error())
+			}
+		})
+	}
+}
+
+func (mc *metadataCache) save() error {
+	mc.saveMu.Lock()
+	defer mc.saveMu.Unlock()
+
+	mc.mu.Lock()
+	mc.pending = false
+	data, err := json.Marshal(cacheFile{Version: metadataCacheVersion, Files: mc.entries})
+	mc.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("could not marshal metadata cache: %w", err)
+	}
+
+	if err := writeFileAtomic(mc.path, data); err != nil {
+		return fmt.Errorf("could not write metadata cache: %w", err)
+	}
+
+	return nil
+}
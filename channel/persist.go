@@ -0,0 +1,212 @@
+package channel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"time"
+
+	"video-stream/log"
+)
+
+// scheduleState is what gets written to disk so a channel's programming
+// survives restarts.
+type scheduleState struct {
+	Items     []persistedItem          `json:"items"`
+	NextID    uint64                   `json:"nextId"`
+	Cursors   map[string]string        `json:"cursors,omitempty"`   // last episode scheduled per show
+	Airtime   map[string]time.Duration `json:"airtime,omitempty"`   // total time scheduled per show
+	LastAired map[string]time.Time     `json:"lastAired,omitempty"` // when each file was last scheduled
+}
+
+// persistedItem also keeps the metadata the guide needs, so it doesn't have to
+// be probed again after a restart
+type persistedItem struct {
+	ID          uint64        `json:"id"`
+	Path        string        `json:"path"`
+	Show        string        `json:"show"`
+	Start       time.Time     `json:"start"`
+	End         time.Time     `json:"end"`
+	Fixed       bool          `json:"fixed,omitempty"`
+	Kind        string        `json:"kind,omitempty"`
+	Offset      time.Duration `json:"offset,omitempty"`
+	Name        string        `json:"name,omitempty"`
+	ShowTitle   string        `json:"showTitle,omitempty"`
+	Season      int           `json:"season,omitempty"`
+	Episode     int           `json:"episode,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Duration    time.Duration `json:"duration,omitempty"`
+	Artwork     string        `json:"artwork,omitempty"`
+}
+
+// save writes the schedule to its state file. The file is written next to the
+// old one and renamed over it, so a crash halfway through doesn't leave a
+// truncated schedule behind.
+func (s *schedule) save() error {
+	if s.statePath == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	// Forget about airings that have dropped out of the no-repeat window
+	cutoff := time.Now().Add(-s.cfg.NoRepeat)
+	maps.DeleteFunc(s.lastAired, func(_ string, t time.Time) bool { return t.Before(cutoff) })
+
+	state := scheduleState{
+		NextID:    s.nextID,
+		Cursors:   maps.Clone(s.cursors),
+		Airtime:   maps.Clone(s.airtime),
+		LastAired: maps.Clone(s.lastAired),
+	}
+	s.mu.Unlock()
+
+	for _, si := range s.items() {
+		mf := si.mediafile
+		state.Items = append(state.Items, persistedItem{
+			ID:          si.id,
+			Path:        mf.path,
+			Show:        mf.show,
+			Start:       si.start,
+			End:         si.end,
+			Fixed:       si.fixed,
+			Kind:        si.kind.String(),
+			Offset:      si.offset,
+			Name:        mf.name,
+			ShowTitle:   mf.showTitle,
+			Season:      mf.season,
+			Episode:     mf.episode,
+			Description: mf.description,
+			Duration:    mf.duration,
+			Artwork:     mf.artwork,
+		})
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal schedule: %w", err)
+	}
+
+	if err := writeFileAtomic(s.statePath, data); err != nil {
+		return fmt.Errorf("could not write schedule: %w", err)
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes data to the file at p by way of a temporary file, so
+// a crash halfway through never leaves a truncated file behind
+func writeFileAtomic(p string, data []byte) error {
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return fmt.Errorf("could not create directory: %w", err)
+	}
+
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, p)
+}
+
+// load reads the schedule back from its state file. Items that have already
+// aired are discarded, as is everything from the first item whose file is no
+// longer in the library onwards, the maintainer regenerates those.
+func (s *schedule) load() error {
+	if s.statePath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not read schedule: %w", err)
+	}
+
+	var state scheduleState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("could not parse schedule: %w", err)
+	}
+
+	now := time.Now()
+	items := []scheduleItem{}
+	for _, pi := range state.Items {
+		if !pi.End.After(now) {
+			continue
+		}
+
+		kind := parseItemKind(pi.Kind)
+		lib, ok := s.lookup(kind, pi.Show, pi.Path)
+		if !ok {
+			log.Warn("[schedule::load] scheduled file is no longer in the library, regenerating from here", "file", pi.Path)
+			break
+		}
+		mf := *lib
+
+		mf.name = pi.Name
+		mf.showTitle = pi.ShowTitle
+		mf.season = pi.Season
+		mf.episode = pi.Episode
+		mf.description = pi.Description
+		mf.duration = pi.Duration
+		mf.artwork = pi.Artwork
+
+		items = append(items, scheduleItem{
+			id:        pi.ID,
+			mediafile: mf,
+			start:     pi.Start,
+			end:       pi.End,
+			fixed:     pi.Fixed,
+			kind:      kind,
+			offset:    pi.Offset,
+		})
+	}
+
+	s.mu.Lock()
+	s.scheduled = items
+	s.nextID = state.NextID
+	if state.Cursors != nil {
+		s.cursors = state.Cursors
+	}
+	if state.Airtime != nil {
+		s.airtime = state.Airtime
+	}
+	if state.LastAired != nil {
+		s.lastAired = state.LastAired
+	}
+	s.mu.Unlock()
+
+	return nil
+}
+
+// lookup finds the library entry for a file in a show, or in the filler or
+// idents for items of those kinds
+func (s *schedule) lookup(kind itemKind, show string, filePath string) (*mediafile, bool) {
+	files := s.media[show]
+	switch kind {
+	case kindFiller:
+		files = s.filler
+	case kindIdent:
+		files = s.idents
+	case kindAd:
+		files = s.ads
+	case kindSignOn:
+		files = []*mediafile{s.signOn}
+	case kindSignOff:
+		files = []*mediafile{s.signOff}
+	case kindOffAir:
+		mf := offAirFile
+		return &mf, true
+	}
+
+	for _, mf := range files {
+		if mf != nil && mf.path == filePath {
+			return mf, true
+		}
+	}
+
+	return nil, false
+}
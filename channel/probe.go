@@ -0,0 +1,260 @@
+package channel
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mediaInfo is everything ffprobe has to say about a file
+type mediaInfo struct {
+	Format    string            `json:"format"` // container, e.g. "matroska,webm"
+	Duration  time.Duration     `json:"duration"`
+	BitRate   int               `json:"bitRate,omitempty"` // bits per second
+	Tags      map[string]string `json:"tags,omitempty"`    // with lower case keys, taggers capitalise differently
+	Video     []videoStream     `json:"video,omitempty"`
+	Audio     []audioStream     `json:"audio,omitempty"`
+	Subtitles []subtitleStream  `json:"subtitles,omitempty"`
+	Chapters  []chapter         `json:"chapters,omitempty"`
+}
+
+type videoStream struct {
+	Index      int               `json:"index"`
+	Codec      string            `json:"codec"`
+	Profile    string            `json:"profile,omitempty"`
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	FrameRate  float64           `json:"frameRate,omitempty"`  // frames per second
+	FieldOrder string            `json:"fieldOrder,omitempty"` // "progressive", or which field comes first for interlaced video
+	PixFmt     string            `json:"pixFmt,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+type audioStream struct {
+	Index         int               `json:"index"`
+	Codec         string            `json:"codec"`
+	Profile       string            `json:"profile,omitempty"`
+	Channels      int               `json:"channels"`
+	ChannelLayout string            `json:"channelLayout,omitempty"`
+	SampleRate    int               `json:"sampleRate,omitempty"`
+	Language      string            `json:"language,omitempty"`
+	Title         string            `json:"title,omitempty"`
+	Default       bool              `json:"default,omitempty"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+type subtitleStream struct {
+	Index    int               `json:"index"`
+	Codec    string            `json:"codec"`
+	Language string            `json:"language,omitempty"`
+	Title    string            `json:"title,omitempty"`
+	Default  bool              `json:"default,omitempty"`
+	Forced   bool              `json:"forced,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+type chapter struct {
+	Start time.Duration     `json:"start"`
+	End   time.Duration     `json:"end"`
+	Title string            `json:"title,omitempty"`
+	Tags  map[string]string `json:"tags,omitempty"`
+}
+
+// Languages returns the language of each audio stream that has one, by stream
+// index
+func (info *mediaInfo) Languages() map[int]string {
+	langs := make(map[int]string)
+	for _, a := range info.Audio {
+		if a.Language != "" {
+			langs[a.Index] = a.Language
+		}
+	}
+
+	return langs
+}
+
+// ChapterStarts returns the start time of each chapter
+func (info *mediaInfo) ChapterStarts() []time.Duration {
+	var starts []time.Duration
+	for _, ch := range info.Chapters {
+		starts = append(starts, ch.Start)
+	}
+
+	return starts
+}
+
+// ffprobe's JSON output, only what's used
+type probeOutput struct {
+	Format struct {
+		FormatName string            `json:"format_name"`
+		Duration   string            `json:"duration"`
+		BitRate    string            `json:"bit_rate"`
+		Tags       map[string]string `json:"tags"`
+	} `json:"format"`
+	Streams []struct {
+		Index         int               `json:"index"`
+		CodecType     string            `json:"codec_type"`
+		CodecName     string            `json:"codec_name"`
+		Profile       string            `json:"profile"`
+		Width         int               `json:"width"`
+		Height        int               `json:"height"`
+		AvgFrameRate  string            `json:"avg_frame_rate"`
+		RFrameRate    string            `json:"r_frame_rate"`
+		FieldOrder    string            `json:"field_order"`
+		PixFmt        string            `json:"pix_fmt"`
+		Channels      int               `json:"channels"`
+		ChannelLayout string            `json:"channel_layout"`
+		SampleRate    string            `json:"sample_rate"`
+		Disposition   map[string]int    `json:"disposition"`
+		Tags          map[string]string `json:"tags"`
+	} `json:"streams"`
+	Chapters []struct {
+		StartTime string            `json:"start_time"`
+		EndTime   string            `json:"end_time"`
+		Tags      map[string]string `json:"tags"`
+	} `json:"chapters"`
+}
+
+// probe runs ffprobe on the file at p
+func probe(p string) (*mediaInfo, error) {
+	cmd := exec.Command(
+		"ffprobe",
+		"-i", p,
+		"-show_format",
+		"-show_streams",
+		"-show_chapters",
+		"-v", "quiet",
+		"-of", "json",
+	)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed: %w", err)
+	}
+
+	var result probeOutput
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+
+	return result.mediaInfo(), nil
+}
+
+// mediaInfo turns ffprobe's output into the model the rest of the package
+// uses
+func (po probeOutput) mediaInfo() *mediaInfo {
+	info := &mediaInfo{
+		Format:   po.Format.FormatName,
+		Duration: seconds(po.Format.Duration),
+		Tags:     lowerKeys(po.Format.Tags),
+	}
+	info.BitRate, _ = strconv.Atoi(po.Format.BitRate)
+
+	for _, st := range po.Streams {
+		tags := lowerKeys(st.Tags)
+
+		switch st.CodecType {
+		case "video":
+			// Cover art shows up as a video stream too
+			if st.Disposition["attached_pic"] == 1 {
+				continue
+			}
+
+			rate := frameRate(st.AvgFrameRate)
+			if rate == 0 {
+				rate = frameRate(st.RFrameRate)
+			}
+
+			info.Video = append(info.Video, videoStream{
+				Index:      st.Index,
+				Codec:      st.CodecName,
+				Profile:    st.Profile,
+				Width:      st.Width,
+				Height:     st.Height,
+				FrameRate:  rate,
+				FieldOrder: st.FieldOrder,
+				PixFmt:     st.PixFmt,
+				Tags:       tags,
+			})
+		case "audio":
+			sampleRate, _ := strconv.Atoi(st.SampleRate)
+			info.Audio = append(info.Audio, audioStream{
+				Index:         st.Index,
+				Codec:         st.CodecName,
+				Profile:       st.Profile,
+				Channels:      st.Channels,
+				ChannelLayout: st.ChannelLayout,
+				SampleRate:    sampleRate,
+				Language:      tags["language"],
+				Title:         tags["title"],
+				Default:       st.Disposition["default"] == 1,
+				Tags:          tags,
+			})
+		case "subtitle":
+			info.Subtitles = append(info.Subtitles, subtitleStream{
+				Index:    st.Index,
+				Codec:    st.CodecName,
+				Language: tags["language"],
+				Title:    tags["title"],
+				Default:  st.Disposition["default"] == 1,
+				Forced:   st.Disposition["forced"] == 1,
+				Tags:     tags,
+			})
+		}
+	}
+
+	for _, ch := range po.Chapters {
+		tags := lowerKeys(ch.Tags)
+		info.Chapters = append(info.Chapters, chapter{
+			Start: seconds(ch.StartTime),
+			End:   seconds(ch.EndTime),
+			Title: tags["title"],
+			Tags:  tags,
+		})
+	}
+
+	return info
+}
+
+// seconds parses a time in seconds like ffprobe writes them, e.g. "1320.48"
+func seconds(s string) time.Duration {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+
+	return time.Duration(f * float64(time.Second))
+}
+
+// frameRate parses a frame rate like ffprobe writes them, e.g. "24000/1001"
+func frameRate(s string) float64 {
+	num, den, ok := strings.Cut(s, "/")
+	if !ok {
+		f, _ := strconv.ParseFloat(s, 64)
+		return f
+	}
+
+	n, err1 := strconv.ParseFloat(num, 64)
+	d, err2 := strconv.ParseFloat(den, 64)
+	if err1 != nil || err2 != nil || d == 0 {
+		return 0
+	}
+
+	return n / d
+}
+
+func lowerKeys(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[strings.ToLower(k)] = v
+	}
+
+	return out
+}
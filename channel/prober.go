@@ -0,0 +1,143 @@
+package channel
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"video-stream/config"
+	"video-stream/log"
+)
+
+// How often to log progress while probing a library
+const probeLogInterval = 10 * time.Second
+
+// probeSlots bounds how many ffprobes run at once across all channels, the
+// size comes from the config so it's made on first use
+var (
+	probeSlots     chan struct{}
+	probeSlotsOnce sync.Once
+)
+
+func acquireProbeSlot(ctx context.Context) bool {
+	probeSlotsOnce.Do(func() {
+		probeSlots = make(chan struct{}, config.Current.Library.ProbeWorkers)
+	})
+
+	select {
+	case probeSlots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func releaseProbeSlot() {
+	<-probeSlots
+}
+
+// ProbeProgress is how far along probing a channel's library is
+type ProbeProgress struct {
+	Running bool `json:"running"`
+	Total   int  `json:"total"`  // files that needed probing
+	Done    int  `json:"done"`   // including the ones that failed
+	Failed  int  `json:"failed"` // files ffprobe couldn't read
+}
+
+// ProbeProgress returns how far along probing the channel's library is
+func (c *Channel) ProbeProgress() ProbeProgress {
+	return c.schedule.probeProgress()
+}
+
+// probeAll probes every file in the library that isn't in the metadata cache
+// yet, a few at a time, so the schedule doesn't have to wait on ffprobe one
+// file at a time when it gets to them. Files are probed into the cache,
+// mediafiles pick their metadata up from there when they need it. A run that
+// starts while another is going waits for it, then probes whatever is still
+// missing. name is the channel's, for the logs.
+func (s *schedule) probeAll(ctx context.Context, name string) {
+	s.probeRun.Lock()
+	defer s.probeRun.Unlock()
+
+	// Scan again rather than wait for the generator to be done with the
+	// library, it's the one waiting on ffprobe at startup
+	todo := []string{}
+	for p := range scanLibrary(s.cfg, log.Debug).paths() {
+		if stat, err := os.Stat(p); err == nil {
+			if _, ok := metadata.get(p, stat); ok {
+				continue
+			}
+		}
+		todo = append(todo, p)
+	}
+
+	if len(todo) == 0 {
+		return
+	}
+
+	s.probeMu.Lock()
+	s.probing = ProbeProgress{Running: true, Total: len(todo)}
+	s.probeMu.Unlock()
+
+	log.Info("[schedule] probing library", "channel", name, "files", len(todo), "workers", config.Current.Library.ProbeWorkers)
+	started := time.Now()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(probeLogInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				progress := s.probeProgress()
+				log.Info("[schedule] probing library", "channel", name, "done", progress.Done, "total", progress.Total, "failed", progress.Failed)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, p := range todo {
+		if !acquireProbeSlot(ctx) {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer releaseProbeSlot()
+
+			_, err := cachedProbe(p)
+			if err != nil {
+				log.Debug("[schedule] could not probe file", "file", p, "error", err.Error())
+			}
+
+			s.probeMu.Lock()
+			s.probing.Done++
+			if err != nil {
+				s.probing.Failed++
+			}
+			s.probeMu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	s.probeMu.Lock()
+	s.probing.Running = false
+	progress := s.probing
+	s.probeMu.Unlock()
+
+	log.Info("[schedule] finished probing library", "channel", name, "done", progress.Done, "total", progress.Total, "failed", progress.Failed, "took", time.Since(started).Round(time.Second))
+	s.refreshCatalog()
+}
+
+func (s *schedule) probeProgress() ProbeProgress {
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+
+	return s.probing
+}
@@ -0,0 +1,426 @@
+package channel
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"time"
+
+	"video-stream/log"
+)
+
+var (
+	ErrNotInLibrary = errors.New("file is not in the channel's library")
+	ErrNoSuchItem   = errors.New("no such item in the schedule")
+	ErrOnAir        = errors.New("item is on air, skip it instead")
+	ErrFixed        = errors.New("item airs at a fixed time, it can't be moved")
+)
+
+// ScheduleEntry is a single item in a channel's schedule
+type ScheduleEntry struct {
+	ID    uint64    `json:"id"`
+	Kind  string    `json:"kind"`
+	Show  string    `json:"show"`
+	Title string    `json:"title"`
+	Path  string    `json:"path"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Fixed bool      `json:"fixed"`
+}
+
+// Schedule returns every item currently scheduled on the channel, including
+// filler, idents and ads.
+func (c *Channel) Schedule() []ScheduleEntry {
+	items := c.schedule.items()
+	out := make([]ScheduleEntry, 0, len(items))
+
+	for _, si := range items {
+		out = append(out, ScheduleEntry{
+			ID:    si.id,
+			Kind:  si.kind.String(),
+			Show:  si.mediafile.show,
+			Title: si.mediafile.name,
+			Path:  si.mediafile.path,
+			Start: si.start,
+			End:   si.end,
+			Fixed: si.fixed,
+		})
+	}
+
+	return out
+}
+
+// Enqueue schedules a file from the channel's library to play right after
+// whatever is on air now.
+func (c *Channel) Enqueue(filePath string) error {
+	return c.schedule.insert(filePath, time.Time{})
+}
+
+// Insert schedules a file from the channel's library to play at the first
+// break between items at or after at.
+func (c *Channel) Insert(filePath string, at time.Time) error {
+	return c.schedule.insert(filePath, at)
+}
+
+// Remove takes an upcoming item off the schedule. Removing part of a program
+// that's split by commercial breaks removes all of it. The channel's sign-off,
+// off air time and sign-on can't be removed.
+func (c *Channel) Remove(id uint64) error {
+	return c.schedule.remove(id)
+}
+
+// Reorder rearranges upcoming items. The items with the given IDs swap places
+// among themselves so they air in the order given, everything else stays put.
+// Items in fixed slots can't be moved.
+func (c *Channel) Reorder(ids []uint64) error {
+	return c.schedule.reorder(ids)
+}
+
+// Manual changes to the schedule all work the same way: the item on air is
+// left alone, the change is made after it, and everything from the change up
+// to the next fixed slot is moved so items follow on from each other again.
+// Fixed slots stay where they are, whatever no longer fits in front of one is
+// cut short and whatever time opens up in front of one is filled.
+
+func (s *schedule) insert(filePath string, at time.Time) error {
+	s.genMu.Lock()
+	defer s.genMu.Unlock()
+
+	mf := s.find(filePath)
+	if mf == nil {
+		return ErrNotInLibrary
+	}
+
+	si := s.newItem(mf, time.Time{})
+	length := si.end.Sub(si.start)
+
+	s.mu.Lock()
+	k := s.upNext(time.Now())
+	for k < len(s.scheduled) && (s.scheduled[k].start.Before(at) || !s.scheduled[k].startsGroup()) {
+		k++
+	}
+
+	si.start = time.Now()
+	if k > 0 {
+		si.start = s.scheduled[k-1].end
+	}
+
+	// A file that doesn't fit in front of the next fixed slot goes after it
+	for f := k; f < len(s.scheduled); f++ {
+		if !s.scheduled[f].fixed {
+			continue
+		}
+		if !si.start.Add(length).After(s.scheduled[f].start) {
+			break
+		}
+
+		_, k = s.group(f)
+		si.start = s.scheduled[k-1].end
+		f = k - 1
+	}
+	si.end = si.start.Add(length)
+
+	items := []scheduleItem{si}
+	s.assignIDs(items)
+	s.scheduled = slices.Insert(s.scheduled, k, items...)
+	gaps := s.relayout(k+1, k+1)
+	s.mu.Unlock()
+
+	s.fillGaps(gaps)
+	log.Info("[schedule] inserted file", "file", filePath, "id", items[0].id)
+	s.saveOrWarn()
+	return nil
+}
+
+func (s *schedule) remove(id uint64) error {
+	s.genMu.Lock()
+	defer s.genMu.Unlock()
+
+	s.mu.Lock()
+	i := slices.IndexFunc(s.scheduled, func(si scheduleItem) bool { return si.id == id })
+	if i < 0 {
+		s.mu.Unlock()
+		return ErrNoSuchItem
+	}
+
+	from, to := s.group(i)
+	if from < s.upNext(time.Now()) {
+		s.mu.Unlock()
+		return ErrOnAir
+	}
+
+	// The channel has to sign off and come back on at its broadcast hours
+	switch s.scheduled[i].kind {
+	case kindOffAir, kindSignOn, kindSignOff:
+		s.mu.Unlock()
+		return ErrFixed
+	}
+
+	s.scheduled = slices.Delete(s.scheduled, from, to)
+	gaps := s.relayout(from, from)
+	s.mu.Unlock()
+
+	s.fillGaps(gaps)
+	log.Info("[schedule] removed item", "id", id)
+	s.saveOrWarn()
+	return nil
+}
+
+func (s *schedule) reorder(ids []uint64) error {
+	s.genMu.Lock()
+	defer s.genMu.Unlock()
+
+	s.mu.Lock()
+	gaps, err := s.rearrange(ids)
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	s.fillGaps(gaps)
+	log.Info("[schedule] reordered items", "ids", ids)
+	s.saveOrWarn()
+	return nil
+}
+
+// rearrange does the work for reorder, returning the gaps to fill. The caller
+// must hold s.mu.
+func (s *schedule) rearrange(ids []uint64) ([]gap, error) {
+	next := s.upNext(time.Now())
+
+	// Find the group each ID belongs to, in the requested order
+	order := [][]scheduleItem{}
+	moved := make(map[int]bool) // start index of groups being moved
+	for _, id := range ids {
+		i := slices.IndexFunc(s.scheduled, func(si scheduleItem) bool { return si.id == id })
+		if i < 0 {
+			return nil, ErrNoSuchItem
+		}
+
+		from, to := s.group(i)
+		if from < next {
+			return nil, ErrOnAir
+		}
+		if slices.ContainsFunc(s.scheduled[from:to], func(si scheduleItem) bool { return si.fixed }) {
+			return nil, ErrFixed
+		}
+		if moved[from] {
+			continue
+		}
+
+		moved[from] = true
+		order = append(order, slices.Clone(s.scheduled[from:to]))
+	}
+
+	// Fill the places of the moved groups with the groups in their new order.
+	// Everything after the last one is as it was.
+	rearranged := slices.Clone(s.scheduled[:next])
+	unchanged := next
+	for i := next; i < len(s.scheduled); {
+		_, to := s.group(i)
+		if moved[i] {
+			rearranged = append(rearranged, order[0]...)
+			order = order[1:]
+			unchanged = len(rearranged)
+		} else {
+			rearranged = append(rearranged, s.scheduled[i:to]...)
+		}
+		i = to
+	}
+
+	s.scheduled = rearranged
+	return s.relayout(next, unchanged), nil
+}
+
+// find looks up a program in the library by its path. The caller must hold
+// s.genMu.
+func (s *schedule) find(filePath string) *mediafile {
+	for _, files := range s.media {
+		for _, mf := range files {
+			if mf.path == filePath {
+				return mf
+			}
+		}
+	}
+
+	return nil
+}
+
+// startsGroup reports whether si is the first item of a group: a program and
+// the breaks and later segments that belong to it, or a single filler clip or
+// ident.
+func (si scheduleItem) startsGroup() bool {
+	return si.kind != kindAd && !(si.kind == kindProgram && si.offset > 0)
+}
+
+// group returns the bounds of the group item i belongs to. The caller must
+// hold s.mu.
+func (s *schedule) group(i int) (int, int) {
+	from := i
+	for from > 0 && !s.scheduled[from].startsGroup() {
+		from--
+	}
+
+	to := i + 1
+	for to < len(s.scheduled) && !s.scheduled[to].startsGroup() {
+		to++
+	}
+
+	return from, to
+}
+
+// upNext returns the index of the first group that isn't on air at t. The
+// caller must hold s.mu.
+func (s *schedule) upNext(t time.Time) int {
+	for i, si := range s.scheduled {
+		if si.start.After(t) && si.startsGroup() {
+			return i
+		}
+	}
+
+	return len(s.scheduled)
+}
+
+// gap is time left empty in front of a fixed item by a change to the schedule
+type gap struct {
+	start time.Time
+	end   time.Time
+}
+
+// relayout moves items after a change to the schedule, starting at index i.
+// Items from i up to rigid are laid out so each starts when the one before
+// ends. Items from rigid on were left as they were, they move together, by
+// whole multiples of the channel's padTo so programs stay on the grid. Fixed
+// items, slots and everything from signing off to signing back on, stay where
+// they are: items that no longer fit in front of one are cut
+// short at its start or dropped, and the gaps that open up are returned to be
+// filled with fillGaps. Episodes dropped or cut short that way come around
+// again. The item before i stays where it is.
+// The caller must hold s.genMu and s.mu.
+func (s *schedule) relayout(i int, rigid int) []gap {
+	gaps := []gap{}
+	lost := []scheduleItem{}
+
+	for i > 0 && i < len(s.scheduled) {
+		f := i
+		for f < len(s.scheduled) && !s.scheduled[f].fixed {
+			f++
+		}
+
+		for j := i; j < min(rigid, f); j++ {
+			length := s.scheduled[j].end.Sub(s.scheduled[j].start)
+			s.scheduled[j].start = s.scheduled[j-1].end
+			s.scheduled[j].end = s.scheduled[j].start.Add(length)
+		}
+
+		if r := max(rigid, i); r < f {
+			shift := s.scheduled[r-1].end.Sub(s.scheduled[r].start)
+			if pad := s.cfg.PadTo; pad > 0 {
+				// Later rather than earlier, the gap in front is filled
+				if shift > 0 {
+					shift = (shift + pad - 1) / pad * pad
+				} else {
+					shift = shift / pad * pad
+				}
+			}
+			for j := r; j < f; j++ {
+				s.scheduled[j].start = s.scheduled[j].start.Add(shift)
+				s.scheduled[j].end = s.scheduled[j].end.Add(shift)
+			}
+		}
+
+		if f < len(s.scheduled) {
+			fixedStart := s.scheduled[f].start
+			k := f
+			for k > i && !s.scheduled[k-1].start.Before(fixedStart) {
+				k--
+			}
+			if s.scheduled[k-1].end.After(fixedStart) {
+				lost = append(lost, s.scheduled[k-1])
+			}
+			if k < f {
+				lost = append(lost, s.scheduled[k:f]...)
+				s.scheduled = slices.Delete(s.scheduled, k, f)
+				rigid -= f - k
+				f = k
+			}
+			if s.scheduled[f-1].end.After(fixedStart) {
+				s.scheduled[f-1].end = fixedStart
+			}
+		}
+
+		for j := i; j <= f && j < len(s.scheduled); j++ {
+			if prev := s.scheduled[j-1].end; prev.Before(s.scheduled[j].start) {
+				gaps = append(gaps, gap{start: prev, end: s.scheduled[j].start})
+			}
+		}
+
+		// Past the fixed item, anything that wasn't changed is as it was
+		if rigid <= f || f == len(s.scheduled) {
+			break
+		}
+		_, i = s.group(f)
+	}
+
+	s.rewind(lost)
+	return gaps
+}
+
+// rewind moves the cursor of each show with an episode in items back to
+// before the first of them, so episodes that were recorded as scheduled but
+// then taken off the schedule or cut short aren't skipped over.
+// The caller must hold s.genMu and s.mu.
+func (s *schedule) rewind(items []scheduleItem) {
+	rewound := map[string]bool{}
+	for _, si := range items {
+		show := si.mediafile.show
+		if si.kind != kindProgram || rewound[show] {
+			continue
+		}
+		rewound[show] = true
+
+		files := s.media[show]
+		switch i := slices.IndexFunc(files, func(mf *mediafile) bool { return mf.path == si.mediafile.path }); {
+		case i > 0:
+			s.cursors[show] = files[i-1].path
+		case i == 0:
+			delete(s.cursors, show)
+		}
+	}
+}
+
+// fillGaps schedules something in each of gaps. Whatever fills them is extra,
+// the episodes already scheduled after them shouldn't be skipped over because
+// of it. The caller must hold s.genMu but not s.mu.
+func (s *schedule) fillGaps(gaps []gap) {
+	for _, g := range gaps {
+		if g.end.Sub(g.start) < minFillGap {
+			continue
+		}
+
+		s.mu.Lock()
+		cursors := maps.Clone(s.cursors)
+		s.mu.Unlock()
+
+		items, err := s.fill(g.start, g.end)
+		if err != nil {
+			log.Warn("[schedule] could not fill gap in schedule", "start", g.start, "end", g.end, "error", err.Error())
+		}
+
+		s.mu.Lock()
+		k := slices.IndexFunc(s.scheduled, func(si scheduleItem) bool { return si.start.Equal(g.end) })
+		if k >= 0 {
+			s.assignIDs(items)
+			s.scheduled = slices.Insert(s.scheduled, k, items...)
+		}
+		s.cursors = cursors
+		s.mu.Unlock()
+	}
+}
+
+func (s *schedule) saveOrWarn() {
+	if err := s.save(); err != nil {
+		log.Warn("[schedule] could not save schedule", "error", err.Error())
+	}
+}
@@ -0,0 +1,196 @@
+package channel
+
+import (
+	"cmp"
+	"math/rand"
+	"path"
+	"slices"
+	"time"
+
+	"video-stream/config"
+	"video-stream/log"
+)
+
+// pickFile chooses the next file to schedule, for an item starting at start.
+// The caller must hold s.genMu.
+func (s *schedule) pickFile(start time.Time) *mediafile {
+	ranked := s.rankShows(s.showsAt(start), start)
+	if len(ranked) == 0 {
+		return nil
+	}
+
+	return s.episodeOf(ranked[0])
+}
+
+// episodeOf picks the file of show to play next, according to the channel's
+// episode order
+func (s *schedule) episodeOf(show string) *mediafile {
+	if s.cfg.Order == config.OrderSequential {
+		return s.nextEpisode(show)
+	}
+
+	return s.randomEpisode(show)
+}
+
+// showsAt returns the shows to pick from at t: those of an override for the
+// date if it has its own directories, otherwise those of the block that's on
+// at t, or the channel's own shows outside of blocks.
+func (s *schedule) showsAt(t time.Time) []string {
+	for i, o := range s.cfg.Overrides {
+		if o.Contains(t) && len(s.overShows[i]) > 0 {
+			return s.overShows[i]
+		}
+	}
+
+	for i, b := range s.cfg.Blocks {
+		if b.Contains(t) && len(s.blockShows[i]) > 0 {
+			return s.blockShows[i]
+		}
+	}
+
+	return s.shows
+}
+
+// rankShows orders shows by how far behind they are on their share of
+// airtime, where a show's share is proportional to its weight. This balances
+// shows by how long they've been on, not how often they were picked, so a show
+// with a handful of short episodes doesn't get as much time as one with
+// hundreds of long ones. Weights are those that apply at t. Shows with nothing
+// left outside the no-repeat window go last, and ties are broken randomly.
+func (s *schedule) rankShows(shows []string, t time.Time) []string {
+	shows = slices.Clone(shows)
+	rand.Shuffle(len(shows), func(i, j int) { shows[i], shows[j] = shows[j], shows[i] })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Shows we haven't seen before start level with the least aired show,
+	// otherwise they'd hog the channel until they'd caught up
+	var least time.Duration = -1
+	for _, show := range shows {
+		if at, ok := s.airtime[show]; ok && (least < 0 || at < least) {
+			least = at
+		}
+	}
+	for _, show := range shows {
+		if _, ok := s.airtime[show]; !ok {
+			s.airtime[show] = max(least, 0)
+		}
+	}
+
+	exhausted := make(map[string]int, len(shows))
+	for _, show := range shows {
+		if len(s.eligible(show)) == 0 {
+			exhausted[show] = 1
+		}
+	}
+
+	slices.SortStableFunc(shows, func(a, b string) int {
+		return cmp.Or(
+			cmp.Compare(exhausted[a], exhausted[b]),
+			cmp.Compare(s.share(a, t), s.share(b, t)),
+		)
+	})
+
+	return shows
+}
+
+// share is a show's airtime scaled by its weight at t. The caller must hold
+// s.mu.
+func (s *schedule) share(show string, t time.Time) float64 {
+	return float64(s.airtime[show]) / s.weight(show, t)
+}
+
+// weight returns a show's configured weight, multiplied by any overrides that
+// are on at t
+func (s *schedule) weight(show string, t time.Time) float64 {
+	w := s.cfg.Weight(show)
+	for _, o := range s.cfg.Overrides {
+		if m, ok := o.Weights[show]; ok && m > 0 && o.Contains(t) {
+			w *= m
+		}
+	}
+
+	return w
+}
+
+// eligible returns the files of show that haven't been scheduled within the
+// no-repeat window. In sequential order episodes come around in turn anyway,
+// so every file is eligible. The caller must hold s.mu.
+func (s *schedule) eligible(show string) []*mediafile {
+	files := s.media[show]
+	if s.cfg.NoRepeat == 0 || s.cfg.Order == config.OrderSequential {
+		return files
+	}
+
+	cutoff := time.Now().Add(-s.cfg.NoRepeat)
+	return slices.DeleteFunc(slices.Clone(files), func(mf *mediafile) bool {
+		return s.lastAired[mf.path].After(cutoff)
+	})
+}
+
+// randomEpisode picks a random file from show that's outside the no-repeat
+// window. If every file has aired recently, the one that aired longest ago is
+// used instead.
+func (s *schedule) randomEpisode(show string) *mediafile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if files := s.eligible(show); len(files) > 0 {
+		return files[rand.Intn(len(files))]
+	}
+
+	return slices.MinFunc(s.media[show], func(a, b *mediafile) int {
+		return s.lastAired[a.path].Compare(s.lastAired[b.path])
+	})
+}
+
+// nextEpisode returns the episode of show that comes after the last one that
+// was scheduled, wrapping around to the first episode after the last. The
+// cursor only moves on once the episode is recorded in the schedule.
+func (s *schedule) nextEpisode(show string) *mediafile {
+	files := s.episodes(show)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := 0
+	if last, ok := s.cursors[show]; ok {
+		if i := slices.IndexFunc(files, func(mf *mediafile) bool { return mf.path == last }); i >= 0 {
+			next = (i + 1) % len(files)
+		}
+	}
+
+	return files[next]
+}
+
+// episodes returns the files of a show in season/episode order. Sorting needs
+// the metadata of every file in the show, so the first call for a show probes
+// all of them.
+func (s *schedule) episodes(show string) []*mediafile {
+	files := s.media[show]
+	if s.sorted[show] {
+		return files
+	}
+
+	log.Info("[schedule] putting episodes in order", "show", show, "files", len(files))
+	for _, mf := range files {
+		if err := mf.LoadMetadata(); err != nil {
+			log.Warn("could not load metadata", "file", mf.path, "error", err.Error())
+		}
+	}
+
+	slices.SortStableFunc(files, func(a, b *mediafile) int {
+		return cmp.Or(
+			cmp.Compare(a.season, b.season),
+			cmp.Compare(a.episode, b.episode),
+			cmp.Compare(path.Base(a.path), path.Base(b.path)),
+		)
+	})
+
+	s.sorted[show] = true
+
+	// Everything in the show has been probed now, the browser can say more
+	go s.refreshCatalog()
+	return files
+}
@@ -0,0 +1,208 @@
+package channel
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"video-stream/config"
+)
+
+// ScanError is a problem scanning part of a media directory. The rest of the
+// directory is still scanned.
+type ScanError struct {
+	Dir  string // the configured directory being scanned
+	Path string // where the problem is, may be Dir itself
+	Err  error
+}
+
+func (e *ScanError) Error() string {
+	if e.Path == e.Dir {
+		return fmt.Sprintf("scanning %s: %v", e.Dir, e.Err)
+	}
+	return fmt.Sprintf("scanning %s: %s: %v", e.Dir, e.Path, e.Err)
+}
+
+func (e *ScanError) Unwrap() error {
+	return e.Err
+}
+
+// logScanErrors reports each of errs with warn, what says what was being
+// looked for
+func logScanErrors(warn func(string, ...any), errs []*ScanError, what string) {
+	for _, err := range errs {
+		warn("could not scan all of "+what, "dir", err.Dir, "path", err.Path, "error", err.Err.Error())
+	}
+}
+
+// scanDir finds the media files in dir and its subdirectories, following the
+// library options. Files are listed under dir even when dir or directories in
+// it are symlinks.
+func scanDir(dir string, opts config.Library) ([]string, []*ScanError) {
+	s := scanner{
+		root:    dir,
+		opts:    opts,
+		visited: make(map[string]bool),
+	}
+
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, []*ScanError{{Dir: dir, Path: dir, Err: err}}
+	}
+
+	s.walk(real, dir)
+	return s.files, s.errs
+}
+
+type scanner struct {
+	root    string
+	opts    config.Library
+	visited map[string]bool // real paths of directories already walked, so symlink loops end
+
+	files []string
+	errs  []*ScanError
+}
+
+// walk scans the directory at real, listing what's in it under as
+func (s *scanner) walk(real string, as string) {
+	if s.visited[real] {
+		return
+	}
+	s.visited[real] = true
+
+	filepath.WalkDir(real, func(p string, d fs.DirEntry, err error) error {
+		rel, _ := filepath.Rel(real, p)
+		shown := filepath.Join(as, rel)
+
+		if err != nil {
+			s.errs = append(s.errs, &ScanError{Dir: s.root, Path: shown, Err: err})
+			return nil // carry on with the rest
+		}
+		if p == real {
+			return nil
+		}
+
+		if s.skip(d.Name(), shown) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			if s.opts.FollowSymlinks {
+				s.follow(p, shown)
+			}
+		case d.Type().IsRegular() && s.isMedia(d.Name()):
+			s.files = append(s.files, shown)
+		}
+
+		return nil
+	})
+}
+
+// follow scans whatever the symlink at p points to
+func (s *scanner) follow(p string, shown string) {
+	target, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		s.errs = append(s.errs, &ScanError{Dir: s.root, Path: shown, Err: err})
+		return
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		s.errs = append(s.errs, &ScanError{Dir: s.root, Path: shown, Err: err})
+		return
+	}
+
+	switch {
+	case info.IsDir():
+		s.walk(target, shown)
+	case info.Mode().IsRegular() && s.isMedia(filepath.Base(shown)):
+		s.files = append(s.files, shown)
+	}
+}
+
+// skip reports whether a file or directory is left out of the library
+func (s *scanner) skip(name string, shown string) bool {
+	if !s.opts.IncludeHidden && strings.HasPrefix(name, ".") {
+		return true
+	}
+
+	rel, _ := filepath.Rel(s.root, shown)
+	return slices.ContainsFunc(s.opts.Exclude, func(glob string) bool {
+		nameMatch, _ := filepath.Match(glob, name)
+		relMatch, _ := filepath.Match(glob, rel)
+		return nameMatch || relMatch
+	})
+}
+
+func (s *scanner) isMedia(name string) bool {
+	return slices.Contains(s.opts.Extensions, strings.ToLower(filepath.Ext(name)))
+}
+
+// Matches season folder names: "Season 1", "Series 02", "S3" and "Specials"
+var seasonDirPattern = regexp.MustCompile(`(?i)^(?:(?:season|series|s)[ ._-]*(\d{1,3})|specials)$`)
+
+// seasonDir returns the season a folder is for, if it's a season folder.
+// Specials are season 0.
+func seasonDir(name string) (int, bool) {
+	m := seasonDirPattern.FindStringSubmatch(name)
+	if m == nil {
+		return 0, false
+	}
+
+	season, _ := strconv.Atoi(m[1])
+	return season, true
+}
+
+// foundFile is a file found in a media directory, with what its place in the
+// directory says about it
+type foundFile struct {
+	path   string
+	show   string // the show folder it's in, empty if the directory is the show
+	season int    // from the season folder it's in, 0 if it isn't in one
+}
+
+// layoutOf works out which show and season each of the files found in dir
+// belong to from the folders they're in. dir is a show, like Show/Season
+// 1/file, unless it's a whole library, like Library/Show/Season 1/file, where
+// each folder in it is a show. Files right in a library belong to it.
+func layoutOf(dir string, files []string, isLibrary bool) []foundFile {
+	// Folders between dir and each file
+	folders := make([][]string, len(files))
+	for i, f := range files {
+		rel, err := filepath.Rel(dir, f)
+		if err != nil {
+			continue
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		folders[i] = parts[:len(parts)-1]
+	}
+
+	out := make([]foundFile, len(files))
+	for i, f := range files {
+		parts := folders[i]
+		out[i] = foundFile{path: f}
+
+		if isLibrary && len(parts) > 0 {
+			out[i].show = parts[0]
+			parts = parts[1:]
+		}
+
+		// The innermost season folder wins
+		for _, part := range parts {
+			if season, ok := seasonDir(part); ok {
+				out[i].season = season
+			}
+		}
+	}
+
+	return out
+}
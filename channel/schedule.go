@@ -1,16 +1,14 @@
 package channel
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"maps"
-	"math/rand"
 	"os"
-	"os/exec"
 	"path"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"video-stream/config"
@@ -18,123 +16,428 @@ import (
 )
 
 type scheduleItem struct {
+	id        uint64
 	mediafile mediafile
 	start     time.Time
 	end       time.Time
+	fixed     bool // airs in a fixed slot, so it mustn't be moved
+	kind      itemKind
+	offset    time.Duration // where in the file the item starts, for programs split by commercial breaks
 }
 
+// isContinuationOf reports whether si is a later segment of the same program
+// as other
+func (si scheduleItem) isContinuationOf(other scheduleItem) bool {
+	return si.kind == kindProgram && si.offset > other.offset && si.mediafile.path == other.mediafile.path
+}
+
+// How often the schedule is trimmed and extended in the background
+const scheduleMaintainInterval = time.Minute
+
+// Upper limit on the number of programs scheduled ahead, regardless of horizon
+const maxScheduleItems = 100
+
 type schedule struct {
-	media     map[string][]mediafile
+	mu        sync.Mutex // guards scheduled, nextID, cursors, airtime, lastAired and catalog
+	genMu     sync.Mutex // serialises generate and changes to the library
 	scheduled []scheduleItem
+	nextID    uint64
+	statePath string // where the schedule is persisted, empty to disable
+	cfg       config.Channel
+
+	library
+	probeRun   sync.Mutex       // one probeAll at a time
+	probeMu    sync.Mutex       // guards probing and validating
+	probing    ProbeProgress    // how far along probing the library is
+	validating ValidateProgress // how far along test decoding the library is
+	signOn     *mediafile
+	signOff    *mediafile
+	lastIdent  time.Time
+
+	cursors   map[string]string        // show name -> path of the last episode scheduled
+	sorted    map[string]bool          // shows whose episodes have been put in order
+	airtime   map[string]time.Duration // show name -> total time scheduled
+	lastAired map[string]time.Time     // path -> when it was last scheduled to start
+
+	catalogMu sync.Mutex                // one refreshCatalog at a time
+	catalog   map[string][]LibraryEntry // show name -> the library as it's browsed
 }
 
-func newSchedule(shows []string) *schedule {
-	media, err := findMedia(shows)
-	if err != nil {
-		log.Error("could not find media", "msg", err.Error())
-		return nil
+func newSchedule(cfg config.Channel, statePath string) *schedule {
+	s := &schedule{
+		library:   scanLibrary(cfg, log.Warn),
+		signOn:    findSignClip(cfg.SignOn, "sign-on"),
+		signOff:   findSignClip(cfg.SignOff, "sign-off"),
+		statePath: statePath,
+		cfg:       cfg,
+		cursors:   make(map[string]string),
+		sorted:    make(map[string]bool),
+		airtime:   make(map[string]time.Duration),
+		lastAired: make(map[string]time.Time),
 	}
 
-	return &schedule{
-		media: media,
+	if err := s.load(); err != nil {
+		log.Warn("could not load saved schedule, starting from scratch", "path", statePath, "error", err.Error())
 	}
-}
 
-func findMedia(dirs []string) (map[string][]mediafile, error) {
+	return s
+}
 
-	out := make(map[string][]mediafile, 0)
+// findMedia scans dirs for media files. A directory is a show, named after the
+// directory, unless it ends in /* to say it's a whole library of show folders,
+// like /media/tv/*. Then each folder in it is a show. Directories that can't
+// be scanned completely still give whatever could be found in them.
+func findMedia(dirs []string) (map[string][]*mediafile, []*ScanError) {
+	out := make(map[string][]*mediafile, 0)
+	errs := []*ScanError{}
 
 	for _, dir := range dirs {
-		cmd := exec.Command(
-			"find",
-			os.ExpandEnv(dir),
-			"-type", "f",
-			"-iregex", ".*\\.\\(mp4\\|mkv\\|mov\\|avi\\|flv\\|wmv\\|webm\\)$",
-		)
+		dir, isLibrary := strings.CutSuffix(dir, "/*")
+		root := os.ExpandEnv(dir)
+		files, scanErrs := scanDir(root, config.Current.Library)
+		errs = append(errs, scanErrs...)
 
-		var buf bytes.Buffer
-		cmd.Stdout = &buf
+		// Files that keep failing to play are left out until they change
+		files = slices.DeleteFunc(files, failures.isQuarantined)
+		if len(files) == 0 {
+			continue
+		}
 
-		err := cmd.Run()
-		if err != nil {
-			log.Debug(cmd.String())
-			log.Error(buf.String())
-			return nil, err
+		for _, f := range layoutOf(root, files, isLibrary) {
+			showName := f.show
+			if showName == "" {
+				showName = path.Base(dir)
+			}
+			out[showName] = append(out[showName], &mediafile{path: f.path, show: showName, dirSeason: f.season})
 		}
+	}
 
-		// Split output by newlines to get individual file paths
-		files := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	return out, errs
+}
+
+// addToLibrary finds the media in dirs and adds it to media, returning the
+// names of the shows found.
+func addToLibrary(media map[string][]*mediafile, dirs []string, warn func(string, ...any)) []string {
+	if len(dirs) == 0 {
+		return nil
+	}
 
-		showName := path.Base(dir)
-		out[showName] = make([]mediafile, len(files))
-		for i, f := range files {
-			out[showName][i] = mediafile{path: f, show: showName}
+	found, errs := findMedia(dirs)
+	logScanErrors(warn, errs, "media")
+
+	for show, files := range found {
+		if _, ok := media[show]; !ok {
+			media[show] = files
 		}
 	}
 
-	return out, nil
+	return slices.Collect(maps.Keys(found))
 }
 
 // Returns a copy of the generated schedule or an error
 func (s *schedule) generate(ctx context.Context) ([]scheduleItem, error) {
+	// Only one generator at a time, otherwise two of them could append after
+	// the same last item
+	s.genMu.Lock()
+	defer s.genMu.Unlock()
+
+	appended := false
+	defer func() {
+		if appended {
+			if err := s.save(); err != nil {
+				log.Warn("[schedule::generate] could not save schedule", "error", err.Error())
+			}
+		}
+	}()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return []scheduleItem{}, errors.New("context canceled")
 		default:
-			var endTime time.Time
+			s.mu.Lock()
+			endTime := s.endTime()
+			full := endTime.After(time.Now().Add(config.Current.ScheduleHorizon)) || s.programCount() >= maxScheduleItems
+			s.mu.Unlock()
 
-			if len(s.scheduled) > 0 {
-				endTime = s.scheduled[len(s.scheduled)-1].end
-			} else {
-				endTime = time.Now()
+			if full {
+				return s.items(), nil
 			}
 
-			if endTime.After(time.Now().Add(config.Current.ScheduleHorizon)) || len(s.scheduled) >= 100 { // Either longer than configured, or 100 files
-				return s.scheduled, nil
+			// Probing happens outside the lock so the player isn't kept waiting
+			items, err := s.nextItems(endTime)
+			if err != nil {
+				return s.items(), err
 			}
 
-			rf := s.randomFile()
-			dur, _ := rf.Duration() // don't care about errors here
+			s.mu.Lock()
+			s.assignIDs(items)
+			s.scheduled = append(s.scheduled, items...)
+			s.mu.Unlock()
+			appended = true
+		}
+	}
+}
+
+// nextItems works out what to schedule from start onwards. That's usually a
+// single file, but can be a few to fill the time until a fixed slot or the
+// channel signing off. The caller must hold s.genMu.
+func (s *schedule) nextItems(start time.Time) ([]scheduleItem, error) {
+	if onAt, ok := s.offAir(start); ok {
+		return s.offAirItems(start, onAt), nil
+	}
+
+	deadline, slot, hasDeadline := s.nextDeadline(start)
+	if hasDeadline && deadline.Sub(start) < minFillGap {
+		if slot == nil {
+			return s.signOffItems(start), nil
+		}
+
+		si := s.newItem(s.nextEpisode(slot.Show), deadline)
+		si.fixed = true
+
+		items := s.withBreaks(si)
+		for _, item := range items {
+			s.record(item)
+		}
+		return append(items, s.breakAfter(items[len(items)-1].end)...), nil
+	}
+
+	rf := s.pickFile(start)
+	if rf == nil {
+		return nil, errors.New("no media to schedule")
+	}
+
+	items := s.withBreaks(s.newItem(rf, start))
+	if hasDeadline && items[len(items)-1].end.After(deadline) {
+		// Doesn't fit before the deadline, try to find something that does
+		return s.fill(start, deadline)
+	}
+
+	for _, item := range items {
+		s.record(item)
+	}
+	return append(items, s.breakAfter(items[len(items)-1].end)...), nil
+}
+
+// newItem creates a schedule item that plays mf in full from start
+func (s *schedule) newItem(mf *mediafile, start time.Time) scheduleItem {
+	if mf.name == "" {
+		if err := mf.LoadMetadata(); err != nil {
+			log.Warn("could not load metadata", "file", mf.path, "error", err.Error())
+		}
+	}
+	dur, _ := mf.Duration() // don't care about errors here
+
+	log.Debug("appending new file to schedule", "file", mf.path)
+	return scheduleItem{
+		mediafile: *mf,
+		start:     start,
+		end:       start.Add(dur).Add(time.Second), // add a little margin
+	}
+}
+
+// record keeps track of what has been scheduled, for airtime balancing, the
+// no-repeat window and episode order.
+func (s *schedule) record(si scheduleItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch si.kind {
+	case kindIdent:
+		s.lastIdent = si.start
+		return
+	case kindFiller, kindAd, kindSignOn, kindSignOff, kindOffAir:
+		return
+	}
+
+	s.airtime[si.mediafile.show] += si.end.Sub(si.start)
+	s.lastAired[si.mediafile.path] = si.start
+
+	// An episode that gets cut short comes around again next time
+	if si.offset+si.end.Sub(si.start) >= si.mediafile.duration {
+		s.cursors[si.mediafile.show] = si.mediafile.path
+	}
+}
 
-			log.Debug("appending new file to schedule", "file", rf.path)
-			si := scheduleItem{
-				mediafile: rf,
-				start:     endTime,
-				end:       endTime.Add(dur).Add(time.Second), // add a little margin
+// maintain keeps the schedule filled up to the configured horizon and drops
+// items once they've aired. It blocks until ctx is canceled, regardless of
+// whether anyone is watching the channel.
+func (s *schedule) maintain(ctx context.Context) {
+	ticker := time.NewTicker(scheduleMaintainInterval)
+	defer ticker.Stop()
+
+	for {
+		s.trim(time.Now())
+
+		generated, err := s.generate(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
 			}
+			log.Warn("[schedule::maintain] could not extend schedule", "error", err.Error())
+		} else if len(generated) > 0 {
+			log.Debug("[schedule::maintain] schedule extended", "items", len(generated), "until", generated[len(generated)-1].end.Format(time.DateTime))
+		}
+
+		if err := s.save(); err != nil {
+			log.Warn("[schedule::maintain] could not save schedule", "error", err.Error())
+		}
 
-			s.scheduled = append(s.scheduled, si)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
 	}
 }
 
-func (s *schedule) nextFile() mediafile {
-	// TODO:
-	// - determine if time.Now() exists inside s.scheduled
-	// - if not, call generate() before continuing
-	// - play the correct file at the correct start time
+// endTime returns when the last scheduled item ends, or now if that's in the
+// past. The caller must hold s.mu.
+func (s *schedule) endTime() time.Time {
+	var endTime time.Time
+	if len(s.scheduled) > 0 {
+		endTime = s.scheduled[len(s.scheduled)-1].end
+	}
 
-	next := s.scheduled[0]
-	s.scheduled = s.scheduled[0:] // because scheduled is max 100 items it's not worth using a linked list or whatever
+	// Don't schedule anything in the past
+	if endTime.Before(time.Now()) {
+		endTime = time.Now()
+	}
 
-	return next.mediafile
+	return endTime
+}
+
+// assignIDs gives newly scheduled items their IDs. The caller must hold s.mu.
+func (s *schedule) assignIDs(items []scheduleItem) {
+	for i := range items {
+		s.nextID++
+		items[i].id = s.nextID
+	}
 }
 
-func (s schedule) randomFile() mediafile {
-	// Pick a random show
-	randomIdx := rand.Intn(len(s.media))
-	keys := slices.Collect(maps.Keys(s.media))
-	key := keys[randomIdx]
-	files := s.media[key]
+// programCount returns how many programs are scheduled, not counting filler
+// and idents. The caller must hold s.mu.
+func (s *schedule) programCount() int {
+	n := 0
+	for _, si := range s.scheduled {
+		if si.kind == kindProgram {
+			n++
+		}
+	}
+
+	return n
+}
+
+// items returns a copy of the scheduled items
+func (s *schedule) items() []scheduleItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.scheduled)
+}
+
+// itemAt returns the item that airs at t, along with how far into the item t
+// is. Items that finished airing before t are dropped, and the schedule is
+// extended if it doesn't reach t yet.
+func (s *schedule) itemAt(ctx context.Context, t time.Time) (scheduleItem, time.Duration, error) {
+	s.trim(t)
+
+	s.mu.Lock()
+	covered := len(s.scheduled) > 0 && !s.scheduled[len(s.scheduled)-1].end.Before(t)
+	s.mu.Unlock()
+
+	if !covered {
+		if _, err := s.generate(ctx); err != nil {
+			return scheduleItem{}, 0, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, si := range s.scheduled {
+		if si.end.After(t) {
+			// If t is in a gap, e.g. just before a fixed slot, the next item
+			// starts a little early
+			return si, max(t.Sub(si.start), 0), nil
+		}
+	}
+
+	return scheduleItem{}, 0, errors.New("schedule is empty")
+}
+
+// itemAfter returns the first item that starts after t, extending the schedule
+// if there isn't one yet.
+func (s *schedule) itemAfter(ctx context.Context, t time.Time) (scheduleItem, error) {
+	for range 2 {
+		for _, si := range s.items() {
+			if si.start.After(t) {
+				return si, nil
+			}
+		}
+
+		if _, err := s.generate(ctx); err != nil {
+			return scheduleItem{}, err
+		}
+	}
+
+	return scheduleItem{}, errors.New("no item scheduled after " + t.Format(time.DateTime))
+}
+
+// skip ends the item that started at start early, at t, and moves everything
+// after it forward. On channels that pad to a grid everything moves by whole
+// multiples of padTo, and fixed slots don't move at all. The time that opens
+// up after t is filled with something else.
+func (s *schedule) skip(start time.Time, t time.Time) {
+	s.genMu.Lock()
+	defer s.genMu.Unlock()
+
+	s.mu.Lock()
+	i := slices.IndexFunc(s.scheduled, func(si scheduleItem) bool { return si.start.Equal(start) })
+	if i < 0 {
+		s.mu.Unlock()
+		return
+	}
+
+	// Skipping part of a program skips the rest of it, and the breaks in it
+	skipped := s.scheduled[i]
+	rest := i + 1
+	for rest < len(s.scheduled) && (s.scheduled[rest].kind == kindAd || s.scheduled[rest].isContinuationOf(skipped)) {
+		rest++
+	}
+	s.scheduled = slices.Delete(s.scheduled, i+1, rest)
+
+	// The rest moves up by whole multiples of padTo so programs stay on the
+	// grid, whatever that leaves open gets filled
+	s.scheduled[i].end = t
+	gaps := s.relayout(i+1, i+1)
+	s.mu.Unlock()
+
+	s.fillGaps(gaps)
+
+	if err := s.save(); err != nil {
+		log.Warn("[schedule::skip] could not save schedule", "error", err.Error())
+	}
+}
+
+// trim drops every item that finished airing before t
+func (s *schedule) trim(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := 0
+	for i < len(s.scheduled) && !s.scheduled[i].end.After(t) {
+		i++
+	}
 
-	// Pick a random file
-	randomIdx = rand.Intn(len(files))
-	return files[randomIdx]
+	s.scheduled = s.scheduled[i:]
 }
 
 // Unused?
-func (s schedule) timeRemaining() (time.Duration, error) {
+func (s *schedule) timeRemaining() (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	// get last item
 	if len(s.scheduled) == 0 {
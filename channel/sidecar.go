@@ -0,0 +1,167 @@
+package channel
+
+import (
+	"cmp"
+	"encoding/xml"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"video-stream/log"
+)
+
+// episodeNFO is the part of a Kodi/Jellyfin episode .nfo that's used
+type episodeNFO struct {
+	XMLName   xml.Name `xml:"episodedetails"`
+	Title     string   `xml:"title"`
+	ShowTitle string   `xml:"showtitle"`
+	Season    int      `xml:"season"`
+	Episode   int      `xml:"episode"`
+	Plot      string   `xml:"plot"`
+}
+
+// showNFO is the part of a Kodi/Jellyfin tvshow.nfo that's used
+type showNFO struct {
+	XMLName xml.Name `xml:"tvshow"`
+	Title   string   `xml:"title"`
+}
+
+// readNFO parses the .nfo at p into v. A missing file isn't an error, it just
+// returns false.
+func readNFO(p string, v any) bool {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn("could not read nfo", "path", p, "error", err.Error())
+		}
+		return false
+	}
+
+	// Only the first element is parsed, so NFOs with a scraper URL after the
+	// XML are fine too
+	if err := xml.Unmarshal(data, v); err != nil {
+		log.Warn("could not parse nfo", "path", p, "error", err.Error())
+		return false
+	}
+
+	return true
+}
+
+// showDirs returns the directories show-wide sidecars of the file at p can be
+// in: the file's own directory, and the one above it for files in season
+// folders
+func showDirs(p string) []string {
+	dir := path.Dir(p)
+	return []string{dir, path.Dir(dir)}
+}
+
+// loadSidecars fills in details from .nfo files next to the file, and from the
+// file name, and finds its artwork. NFOs are written by people or scrapers on
+// purpose, so they win over tags. The file name is a last resort.
+func (mf *mediafile) loadSidecars() {
+	base := strings.TrimSuffix(mf.path, path.Ext(mf.path))
+
+	var ep episodeNFO
+	if readNFO(base+".nfo", &ep) {
+		mf.name = cmp.Or(ep.Title, mf.name)
+		mf.showTitle = cmp.Or(ep.ShowTitle, mf.showTitle)
+		mf.description = cmp.Or(ep.Plot, mf.description)
+		if ep.Season > 0 || ep.Episode > 0 {
+			mf.season, mf.episode = ep.Season, ep.Episode
+		}
+	}
+
+	if mf.showTitle == "" {
+		for _, dir := range showDirs(mf.path) {
+			var show showNFO
+			if readNFO(path.Join(dir, "tvshow.nfo"), &show) && show.Title != "" {
+				mf.showTitle = show.Title
+				break
+			}
+		}
+	}
+
+	fromName := parseFilename(mf.path)
+	mf.name = cmp.Or(mf.name, fromName.title)
+	mf.showTitle = cmp.Or(mf.showTitle, fromName.show)
+	if mf.season == 0 && mf.episode == 0 {
+		mf.season, mf.episode = fromName.season, fromName.episode
+	}
+	if mf.season == 0 {
+		mf.season = mf.dirSeason
+	}
+
+	mf.artwork = findArtwork(mf.path)
+}
+
+// Image extensions artwork can have, in order of preference
+var artworkExtensions = []string{".jpg", ".jpeg", ".png"}
+
+// findArtwork returns the path of the artwork for the file at p: its own
+// thumbnail if it has one, otherwise the show's poster. Empty if there's none.
+func findArtwork(p string) string {
+	base := strings.TrimSuffix(p, path.Ext(p))
+
+	candidates := []string{}
+	for _, ext := range artworkExtensions {
+		candidates = append(candidates, base+"-thumb"+ext, base+ext)
+	}
+	for _, dir := range showDirs(p) {
+		for _, name := range []string{"poster", "folder"} {
+			for _, ext := range artworkExtensions {
+				candidates = append(candidates, path.Join(dir, name+ext))
+			}
+		}
+	}
+
+	for _, c := range candidates {
+		if info, err := os.Stat(c); err == nil && info.Mode().IsRegular() {
+			return c
+		}
+	}
+
+	return ""
+}
+
+// Matches 1x02 and the like, but not resolutions like 1920x1080
+var crossEpisodePattern = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])(\d{1,2})x(\d{2,3})(?:[^a-z0-9]|$)`)
+
+// Matches "Show - 1x02 - Title" and "Show - S01E02 - Title"
+var showEpisodeTitlePattern = regexp.MustCompile(`(?i)^(.+?)\s+-\s+(?:s\d{1,3}[ ._-]?e\d{1,4}|\d{1,2}x\d{2,3})\s+-\s+(.+)$`)
+
+// filenameDetails is what can be worked out from a file's name
+type filenameDetails struct {
+	show    string
+	title   string
+	season  int
+	episode int
+}
+
+// parseFilename works out what it can from the name of the file at p
+func parseFilename(p string) filenameDetails {
+	var d filenameDetails
+
+	d.season, d.episode, _ = episodeFromFilename(p)
+
+	name := strings.TrimSuffix(path.Base(p), path.Ext(p))
+	if m := showEpisodeTitlePattern.FindStringSubmatch(name); m != nil {
+		d.show = strings.TrimSpace(m[1])
+		d.title = strings.TrimSpace(m[2])
+	}
+
+	return d
+}
+
+// crossEpisode parses season and episode numbers written like 1x02
+func crossEpisode(name string) (season int, episode int, ok bool) {
+	m := crossEpisodePattern.FindStringSubmatch(name)
+	if m == nil {
+		return 0, 0, false
+	}
+
+	season, _ = strconv.Atoi(m[1])
+	episode, _ = strconv.Atoi(m[2])
+	return season, episode, true
+}
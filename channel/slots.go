@@ -0,0 +1,76 @@
+package channel
+
+import (
+	"errors"
+	"time"
+
+	"video-stream/config"
+	"video-stream/log"
+)
+
+// Gaps shorter than this aren't worth filling, the next item just starts a
+// little early instead
+const minFillGap = 10 * time.Second
+
+// How many shows to try when looking for a file that fits in a gap
+const fillAttempts = 5
+
+// nextDeadline returns the next time at or after t that the schedule has to
+// hit exactly: the first fixed slot that comes around, or when the channel
+// has to start signing off, whichever is first. The slot is nil for signing
+// off.
+func (s *schedule) nextDeadline(t time.Time) (time.Time, *config.Slot, bool) {
+	next, found := s.closing(t)
+	var slot *config.Slot
+
+	for i, sl := range s.slots {
+		at := sl.Next(t)
+		if !found || at.Before(next) {
+			next, slot, found = at, &s.slots[i], true
+		}
+	}
+
+	return next, slot, found
+}
+
+// fill schedules items to cover the time from start until until. The first
+// few shows in line each get a chance to fit their next file in the time
+// that's left. If none of them do the rest of the time is padded with filler,
+// or if there isn't any the first in line is cut off at until.
+// The caller must hold s.genMu.
+func (s *schedule) fill(start time.Time, until time.Time) ([]scheduleItem, error) {
+	items := []scheduleItem{}
+
+	for until.Sub(start) >= minFillGap {
+		ranked := s.rankShows(s.showsAt(start), start)
+		if len(ranked) == 0 {
+			return items, errors.New("no media to schedule")
+		}
+
+		si := s.newItem(s.episodeOf(ranked[0]), start)
+		for _, show := range ranked[1:min(len(ranked), fillAttempts)] {
+			if !si.end.After(until) {
+				break
+			}
+			si = s.newItem(s.episodeOf(show), start)
+		}
+
+		if si.end.After(until) {
+			// Pad the gap with filler if there is any, otherwise cut a program short
+			if padding := s.pad(start, until); len(padding) > 0 {
+				items = append(items, padding...)
+				break
+			}
+
+			log.Debug("nothing fits before fixed slot, cutting file short", "file", si.mediafile.path, "until", until.Format(time.DateTime))
+			si = s.newItem(s.episodeOf(ranked[0]), start)
+			si.end = until
+		}
+
+		s.record(si)
+		items = append(items, si)
+		start = si.end
+	}
+
+	return items, nil
+}
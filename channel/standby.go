@@ -0,0 +1,105 @@
+package channel
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+
+	"video-stream/config"
+	"video-stream/log"
+)
+
+// standbyArgs returns ffmpeg arguments for the slate shown while a channel
+// starts up, the configured standby clip on a loop or a plain card with
+// silence if there isn't one, encoded like the channel's stream
+func standbyArgs(profile config.Profile) []string {
+	silence := []string{"-re", "-f", "lavfi", "-i", "anullsrc=channel_layout=stereo:sample_rate=48000"}
+
+	input := append([]string{"-re", "-f", "lavfi", "-i", "color=c=0x1a1a2e:size=1920x1080:rate=25"}, silence...)
+	input = append(input, "-map", "0:v:0", "-map", "1:a:0")
+
+	if clip := config.Current.Standby; clip != "" {
+		input = []string{"-stream_loop", "-1", "-re", "-i", clip}
+
+		// A clip without sound gets silence, clients expect an audio stream
+		if info, err := cachedProbe(clip); err == nil && len(info.Audio) > 0 {
+			input = append(input, "-map", "0:v:0", "-map", "0:a:0")
+		} else {
+			input = append(input, silence...)
+			input = append(input, "-map", "0:v:0", "-map", "1:a:0")
+		}
+	}
+
+	return append(input, outputArgs(profile, directStream{})...)
+}
+
+// standby streams the standby slate to clients until the returned function is
+// called, so they get something right away instead of waiting on a blank pipe
+// until the first program starts. The returned function blocks until the
+// slate has stopped, so none of it ends up after the program's output.
+func (c *Channel) standby(ctx context.Context) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	var mu sync.Mutex
+	stopped := false
+
+	go func() {
+		defer close(done)
+
+		// Only errors on stderr, they say why the slate stopped
+		args := append([]string{"-v", "error"}, standbyArgs(c.schedule.cfg.Transcode)...)
+		cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+		stderr := &tailBuffer{max: 4096}
+		cmd.Stderr = stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			log.Error("[standby] could not create stdout pipe", "error", err.Error(), "channel", c.Name())
+			return
+		}
+
+		if err := cmd.Start(); err != nil {
+			log.Error("[standby] could not run ffmpeg command", "error", err.Error(), "channel", c.Name())
+			return
+		}
+
+		log.Debug("[standby] Showing standby slate", "channel", c.Name())
+
+		buf := make([]byte, 4096)
+		for {
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				data := make([]byte, n)
+				copy(data, buf[:n])
+
+				mu.Lock()
+				if !stopped {
+					c.connections.broadcast(data)
+				}
+				mu.Unlock()
+			}
+			if err != nil {
+				waitErr := cmd.Wait()
+				if ctx.Err() == nil {
+					// It loops until it's stopped, clients are left with nothing
+					log.Error("[standby] standby slate ended early", "reason", waitErr, "error", lastLine(stderr.String()), "channel", c.Name())
+				} else {
+					log.Debug("[standby] ffmpeg ended", "reason", err, "channel", c.Name())
+				}
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			mu.Lock()
+			stopped = true
+			mu.Unlock()
+
+			cancel()
+			<-done
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"slices"
+	"time"
+
+	"video-stream/log"
+)
+
+var ErrValidating = errors.New("library is already being validated")
+
+// ValidateProgress is how far along test decoding a channel's library is
+type ValidateProgress struct {
+	Running     bool `json:"running"`
+	Total       int  `json:"total"`
+	Done        int  `json:"done"`
+	Failed      int  `json:"failed"`      // files that couldn't be decoded
+	Quarantined int  `json:"quarantined"` // of those, files that have now failed too often
+}
+
+// Validate starts test decoding every file in the channel's library in the
+// background. A file that can't be decoded counts as failing to play, so one
+// that's failed too often is quarantined. It runs until it's done or ctx is
+// canceled.
+func (c *Channel) Validate(ctx context.Context) error {
+	s := c.schedule
+
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+	if s.validating.Running {
+		return ErrValidating
+	}
+	s.validating = ValidateProgress{Running: true}
+
+	go s.validate(ctx, c.Name())
+	return nil
+}
+
+// ValidateProgress returns how far along test decoding the channel's library is
+func (c *Channel) ValidateProgress() ValidateProgress {
+	s := c.schedule
+
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+
+	return s.validating
+}
+
+// validate test decodes every file in the library. Files are decoded one at a
+// time, a full decode is as much work as playing the file and the channels
+// still have to keep up with their streams. name is the channel's, for the
+// logs.
+func (s *schedule) validate(ctx context.Context, name string) {
+	s.genMu.Lock()
+	todo := []string{}
+	for p := range s.library.paths() {
+		todo = append(todo, p)
+	}
+	s.genMu.Unlock()
+	slices.Sort(todo)
+
+	s.probeMu.Lock()
+	s.validating.Total = len(todo)
+	s.probeMu.Unlock()
+
+	log.Info("[schedule] validating library", "channel", name, "files", len(todo))
+	started := time.Now()
+
+	for _, p := range todo {
+		if ctx.Err() != nil {
+			break
+		}
+
+		reason := testDecode(ctx, p)
+		if ctx.Err() != nil {
+			break // canceled partway through, that says nothing about the file
+		}
+		quarantined := reason != "" && failures.failed(p, reason)
+
+		s.probeMu.Lock()
+		s.validating.Done++
+		if reason != "" {
+			s.validating.Failed++
+		}
+		if quarantined {
+			s.validating.Quarantined++
+		}
+		s.probeMu.Unlock()
+	}
+
+	s.probeMu.Lock()
+	s.validating.Running = false
+	progress := s.validating
+	s.probeMu.Unlock()
+
+	log.Info("[schedule] finished validating library", "channel", name, "done", progress.Done, "total", progress.Total, "failed", progress.Failed, "quarantined", progress.Quarantined, "took", time.Since(started).Round(time.Second))
+	if progress.Quarantined > 0 {
+		s.rescan()
+	}
+}
+
+// testDecode decodes the whole of the file at p without outputting anything,
+// returning why it couldn't be decoded or "" if it could. Errors ffmpeg gets
+// past, like a few corrupt frames, don't count, the file still plays. Neither
+// do failures that aren't down to the file, like ffmpeg not being installed.
+func testDecode(ctx context.Context, p string) string {
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-v", "error",
+		"-i", p,
+		"-f", "null", "-",
+	)
+
+	stderr := &tailBuffer{max: 4096}
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	if err == nil {
+		return ""
+	}
+
+	blame := inputError(stderr.String(), p)
+	if blame == "" {
+		log.Warn("[schedule] test decode failed, but not because of the file", "file", p, "error", err.Error(), "stderr", lastLine(stderr.String()))
+		return ""
+	}
+
+	return "ffmpeg failed: " + err.Error() + ": " + blame
+}
@@ -1,9 +1,13 @@
 package config
 
 import (
+	"cmp"
 	"errors"
+	"fmt"
 	"os"
 	"path"
+	"slices"
+	"strings"
 	"time"
 
 	yaml "github.com/goccy/go-yaml"
@@ -12,9 +16,261 @@ import (
 )
 
 type Config struct {
-	LogLevel        string              `yaml:"logLevel"`
-	Channels        map[string][]string `yaml:"channels"`
-	ScheduleHorizon time.Duration       `yaml:"scheduleHorizon"`
+	LogLevel        string             `yaml:"logLevel"`
+	Channels        map[string]Channel `yaml:"channels"`
+	ScheduleHorizon time.Duration      `yaml:"scheduleHorizon"`
+	StateDir        string             `yaml:"stateDir"`
+	Standby         string             `yaml:"standby"` // clip to loop while a channel starts up, instead of a generated slate
+	Library         Library            `yaml:"library"`
+	Profiles        map[string]Profile `yaml:"profiles"` // transcode profiles channels can pick from, one called "default" is used by channels that don't pick one
+	Overrides       []Override         `yaml:"overrides"`
+}
+
+// Library controls how media directories are scanned
+type Library struct {
+	Extensions     []string `yaml:"extensions"`     // file extensions of media files, defaults to DefaultExtensions
+	Exclude        []string `yaml:"exclude"`        // globs for files and directories to leave out, matched against names and paths relative to the scanned directory
+	FollowSymlinks bool     `yaml:"followSymlinks"` // scan symlinked files and directories too
+	IncludeHidden  bool     `yaml:"includeHidden"`  // scan files and directories whose names start with a dot
+
+	RescanInterval time.Duration `yaml:"rescanInterval"` // how often to look for new and deleted files, defaults to a minute
+	ProbeWorkers   int           `yaml:"probeWorkers"`   // how many files to probe at once, defaults to 4
+
+	QuarantineAfter int `yaml:"quarantineAfter"` // how many times in a row a file can fail to play before it's taken out of the library, defaults to 3
+}
+
+// Profile is how a channel's stream is encoded. Anything left out is the same
+// as in DefaultProfile.
+type Profile struct {
+	Width     int    `yaml:"width"` // video is scaled to fit and letterboxed
+	Height    int    `yaml:"height"`
+	FrameRate string `yaml:"frameRate"` // e.g. 25 or 30000/1001, leave out to keep each file's own
+
+	VideoCodec   string `yaml:"videoCodec"`   // an ffmpeg encoder, e.g. libx264 or h264_nvenc
+	VideoBitrate string `yaml:"videoBitrate"` // e.g. 4M, leave out to encode for constant quality instead
+	CRF          int    `yaml:"crf"`          // constant quality, used when there's no bitrate, lower is better
+	Preset       string `yaml:"preset"`       // the encoder's speed/quality preset, defaults to veryfast for the default codec
+	GOP          int    `yaml:"gop"`          // frames between keyframes, leave out for the encoder's default
+
+	AudioCodec    string `yaml:"audioCodec"`
+	AudioBitrate  string `yaml:"audioBitrate"`  // e.g. 128k
+	AudioChannels int    `yaml:"audioChannels"` // 2 for stereo, 6 for 5.1
+	SampleRate    int    `yaml:"sampleRate"`    // in Hz
+
+	DirectStream bool `yaml:"directStream"` // send video and audio that already come out like this as they are, instead of re-encoding them
+}
+
+// DefaultProfile is 1080p h.264 with stereo AAC audio
+var DefaultProfile = Profile{
+	Width:         1920,
+	Height:        1080,
+	VideoCodec:    "libx264",
+	Preset:        "veryfast",
+	AudioCodec:    "aac",
+	AudioBitrate:  "128k",
+	AudioChannels: 2,
+	SampleRate:    48000,
+}
+
+// withDefaults fills in whatever p leaves out from DefaultProfile
+func (p Profile) withDefaults() Profile {
+	if p.Width <= 0 || p.Height <= 0 {
+		p.Width, p.Height = DefaultProfile.Width, DefaultProfile.Height
+	}
+
+	// Presets are different for every encoder, only the default one's fits
+	// the default codec
+	if p.VideoCodec == "" {
+		p.VideoCodec = DefaultProfile.VideoCodec
+		p.Preset = cmp.Or(p.Preset, DefaultProfile.Preset)
+	}
+
+	p.AudioCodec = cmp.Or(p.AudioCodec, DefaultProfile.AudioCodec)
+	p.AudioBitrate = cmp.Or(p.AudioBitrate, DefaultProfile.AudioBitrate)
+	if p.AudioChannels <= 0 {
+		p.AudioChannels = DefaultProfile.AudioChannels
+	}
+	if p.SampleRate <= 0 {
+		p.SampleRate = DefaultProfile.SampleRate
+	}
+
+	return p
+}
+
+// DefaultExtensions are the media file extensions used when none are configured
+var DefaultExtensions = []string{".mp4", ".mkv", ".mov", ".avi", ".flv", ".wmv", ".webm"}
+
+// Override changes what channels play on certain dates, like christmas
+// episodes around christmas or more horror in October.
+type Override struct {
+	Name        string             `yaml:"name"`
+	From        MonthDay           `yaml:"from"`
+	To          MonthDay           `yaml:"to"`          // inclusive, may be before From to run into the new year
+	Channels    []string           `yaml:"channels"`    // names of the channels it applies to, empty for all of them
+	Directories []string           `yaml:"directories"` // play only from these directories while the override is on
+	Weights     map[string]float64 `yaml:"weights"`     // multiplies the weights of shows while the override is on
+}
+
+// Contains reports whether t falls within the override's dates
+func (o Override) Contains(t time.Time) bool {
+	md := DateOf(t)
+	if o.From <= o.To {
+		return md >= o.From && md <= o.To
+	}
+
+	return md >= o.From || md <= o.To
+}
+
+// MonthDay is a date that comes around every year, written as "12-24" in the
+// config.
+type MonthDay int
+
+// DateOf returns the month and day of t
+func DateOf(t time.Time) MonthDay {
+	return MonthDay(int(t.Month())*100 + t.Day())
+}
+
+func (md *MonthDay) UnmarshalYAML(unmarshal func(any) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	parsed, err := time.Parse("01-02", str)
+	if err != nil {
+		return fmt.Errorf("invalid date %q, expected MM-DD: %w", str, err)
+	}
+
+	*md = DateOf(parsed)
+	return nil
+}
+
+func (md MonthDay) MarshalYAML() (any, error) {
+	return md.String(), nil
+}
+
+func (md MonthDay) String() string {
+	return fmt.Sprintf("%02d-%02d", int(md)/100, int(md)%100)
+}
+
+// Episode orders a channel can play shows in
+const (
+	OrderRandom     = "random"
+	OrderSequential = "sequential"
+)
+
+type Channel struct {
+	Directories []string        `yaml:"directories"`
+	Order       string          `yaml:"order"`    // OrderRandom (default) or OrderSequential
+	Shows       map[string]Show `yaml:"shows"`    // per-show options, keyed by show name
+	NoRepeat    time.Duration   `yaml:"noRepeat"` // don't air an episode again within this window
+	Blocks      []Block         `yaml:"blocks"`   // time of day programming
+	Slots       []Slot          `yaml:"slots"`    // shows that air at fixed times
+
+	Filler        []string      `yaml:"filler"`        // directories of short clips to play between programs
+	Idents        []string      `yaml:"idents"`        // directories of station idents
+	IdentInterval time.Duration `yaml:"identInterval"` // how often to play an ident, between programs
+	PadTo         time.Duration `yaml:"padTo"`         // pad with filler so programs start on these boundaries, e.g. 30m
+
+	Ads           []string      `yaml:"ads"`           // directories of commercials for breaks during programs
+	BreakInterval time.Duration `yaml:"breakInterval"` // break programs without chapters this often, and no more often than this at chapters
+	BreakLength   time.Duration `yaml:"breakLength"`   // how long each commercial break lasts
+
+	BroadcastHours *Hours `yaml:"broadcastHours"` // when the channel is on air, leave out to broadcast around the clock
+	SignOn         string `yaml:"signOn"`         // clip to play when the channel comes on air
+	SignOff        string `yaml:"signOff"`        // clip to play before the channel goes off air
+
+	Profile string `yaml:"profile"` // name of the transcode profile to stream with
+
+	Overrides []Override `yaml:"-"` // the overrides that apply to this channel, filled in from Config
+	Transcode Profile    `yaml:"-"` // the profile named by Profile, filled in from Config
+}
+
+// Slot airs the next episode of a show at a fixed time, every day or on one day
+// of the week, e.g. "every Saturday at 20:00".
+type Slot struct {
+	Day  string    `yaml:"day"` // weekday like "saturday", empty for every day
+	Time TimeOfDay `yaml:"time"`
+	Show string    `yaml:"show"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// Next returns the first time the slot comes around at or after t
+func (s Slot) Next(t time.Time) time.Time {
+	next := s.Time.Next(t)
+
+	if wd, ok := weekdays[strings.ToLower(s.Day)]; ok {
+		for next.Weekday() != wd {
+			next = s.Time.On(next.AddDate(0, 0, 1))
+		}
+	}
+
+	return next
+}
+
+// Block is a part of the day during which a channel plays from a different set
+// of directories, e.g. cartoons in the morning.
+type Block struct {
+	Start       TimeOfDay `yaml:"start"`
+	End         TimeOfDay `yaml:"end"` // may be before Start to run past midnight
+	Directories []string  `yaml:"directories"`
+}
+
+// Contains reports whether t falls within the block
+func (b Block) Contains(t time.Time) bool {
+	return Hours{Start: b.Start, End: b.End}.Contains(t)
+}
+
+// Hours are the part of the day a channel is on air
+type Hours struct {
+	Start TimeOfDay `yaml:"start"`
+	End   TimeOfDay `yaml:"end"` // may be before Start to run past midnight
+}
+
+// Contains reports whether t falls within the hours
+func (h Hours) Contains(t time.Time) bool {
+	tod := Clock(t)
+	if h.Start <= h.End {
+		return tod >= h.Start && tod < h.End
+	}
+
+	return tod >= h.Start || tod < h.End
+}
+
+type Show struct {
+	// Share of the channel's airtime relative to other shows, defaults to 1
+	Weight float64 `yaml:"weight"`
+}
+
+// Weight returns how much airtime a show should get relative to the others
+func (c Channel) Weight(show string) float64 {
+	if w := c.Shows[show].Weight; w > 0 {
+		return w
+	}
+
+	return 1
+}
+
+// UnmarshalYAML accepts either a plain list of directories, which is how
+// channels were originally configured, or a map of channel options.
+func (c *Channel) UnmarshalYAML(unmarshal func(any) error) error {
+	var dirs []string
+	if err := unmarshal(&dirs); err == nil {
+		c.Directories = dirs
+		return nil
+	}
+
+	type plain Channel // avoid recursing back into this method
+	return unmarshal((*plain)(c))
 }
 
 var Current Config
@@ -28,6 +284,55 @@ func init() {
 	Current = cfg
 }
 
+// TimeOfDay is a wall clock time written as "15:04" in the config, stored as
+// the time since midnight.
+type TimeOfDay time.Duration
+
+// Clock returns the time of day of t
+func Clock(t time.Time) TimeOfDay {
+	return TimeOfDay(time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second)
+}
+
+func (t *TimeOfDay) UnmarshalYAML(unmarshal func(any) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	parsed, err := time.Parse("15:04", str)
+	if err != nil {
+		return fmt.Errorf("invalid time of day %q, expected HH:MM: %w", str, err)
+	}
+
+	*t = Clock(parsed)
+	return nil
+}
+
+func (t TimeOfDay) MarshalYAML() (any, error) {
+	return t.String(), nil
+}
+
+func (t TimeOfDay) String() string {
+	d := time.Duration(t)
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// On returns the time t on the same day as day, in day's location
+func (t TimeOfDay) On(day time.Time) time.Time {
+	d := time.Duration(t)
+	y, m, dd := day.Date()
+	return time.Date(y, m, dd, int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, 0, day.Location())
+}
+
+// Next returns the first time at or after after that it's t
+func (t TimeOfDay) Next(after time.Time) time.Time {
+	next := t.On(after)
+	if next.Before(after) {
+		next = t.On(after.AddDate(0, 0, 1))
+	}
+	return next
+}
+
 func getConfigFilePath() (string, error) {
 	cwd, err := os.Getwd()
 	if err != nil {
@@ -65,6 +370,77 @@ func readConfigFile() (Config, error) {
 		cfg.ScheduleHorizon = time.Duration(2 * time.Hour)
 	}
 
+	if cfg.StateDir == "" {
+		cfg.StateDir = "state"
+	}
+
+	if cfg.Library.RescanInterval <= 0 {
+		cfg.Library.RescanInterval = time.Minute
+	}
+
+	if cfg.Library.ProbeWorkers <= 0 {
+		cfg.Library.ProbeWorkers = 4
+	}
+
+	if cfg.Library.QuarantineAfter <= 0 {
+		cfg.Library.QuarantineAfter = 3
+	}
+
+	if len(cfg.Library.Extensions) == 0 {
+		cfg.Library.Extensions = slices.Clone(DefaultExtensions)
+	}
+	for i, ext := range cfg.Library.Extensions {
+		cfg.Library.Extensions[i] = "." + strings.TrimPrefix(strings.ToLower(ext), ".")
+	}
+
+	cfg.Library.Exclude = slices.DeleteFunc(cfg.Library.Exclude, func(glob string) bool {
+		if _, err := path.Match(glob, ""); err != nil {
+			log.Warn("invalid exclude glob, ignoring it", "glob", glob, "error", err.Error())
+			return true
+		}
+		return false
+	})
+
+	for name, ch := range cfg.Channels {
+		switch ch.Order {
+		case "":
+			ch.Order = OrderRandom
+		case OrderRandom, OrderSequential:
+		default:
+			log.Warn("unknown channel order, falling back to random", "channel", name, "order", ch.Order)
+			ch.Order = OrderRandom
+		}
+
+		ch.Slots = slices.DeleteFunc(ch.Slots, func(slot Slot) bool {
+			if _, ok := weekdays[strings.ToLower(slot.Day)]; slot.Day != "" && !ok {
+				log.Warn("unknown day for slot, ignoring it", "channel", name, "day", slot.Day, "show", slot.Show)
+				return true
+			}
+			return false
+		})
+
+		if h := ch.BroadcastHours; h != nil && h.Start == h.End {
+			log.Warn("broadcast hours start and end at the same time, broadcasting around the clock", "channel", name, "hours", h.Start.String())
+			ch.BroadcastHours = nil
+		}
+
+		profileName := cmp.Or(ch.Profile, "default")
+		profile, ok := cfg.Profiles[profileName]
+		if !ok && ch.Profile != "" {
+			log.Warn("unknown transcode profile, using the default", "channel", name, "profile", ch.Profile)
+			profile = cfg.Profiles["default"]
+		}
+		ch.Transcode = profile.withDefaults()
+
+		for _, o := range cfg.Overrides {
+			if len(o.Channels) == 0 || slices.Contains(o.Channels, name) {
+				ch.Overrides = append(ch.Overrides, o)
+			}
+		}
+
+		cfg.Channels[name] = ch
+	}
+
 	return cfg, nil
 }
 
@@ -16,14 +16,10 @@ import (
 )
 
 // TODO:
-// - Scheduling
-//   - Periodically extend schedule
-//   - Use schedule when deciding what to play
 // - Optimisation
 //   - Dockerise so I can run this on unraid
 // - User Interface
 //   - Add static HTTP routes for channel icons etc
-//   - Add EPG support
 //   - Frontend for monitoring/configuration
 //   - Support skipping episodes via web UI
 
@@ -38,8 +34,8 @@ func main() {
 	log.SetLevel(cfg.LogLevel)
 
 	channels := make([]*channel.Channel, 0, len(cfg.Channels))
-	for name, dirs := range cfg.Channels {
-		channels = append(channels, channel.New(name, dirs))
+	for name, chCfg := range cfg.Channels {
+		channels = append(channels, channel.New(name, chCfg))
 	}
 
 	// Asynchronous stuff starts here
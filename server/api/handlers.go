@@ -0,0 +1,240 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"video-stream/channel"
+	"video-stream/log"
+)
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("[api] could not encode response", "error", err.Error())
+	}
+}
+
+// writeError responds with the status that fits the error from a channel
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, channel.ErrNotInLibrary), errors.Is(err, channel.ErrNoSuchItem), errors.Is(err, channel.ErrNoArtwork), errors.Is(err, channel.ErrNoSuchShow), errors.Is(err, channel.ErrNotQuarantined):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, channel.ErrOnAir), errors.Is(err, channel.ErrValidating), errors.Is(err, channel.ErrFixed):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// withChannel looks up the channel in the request path and passes it to the
+// handler, or responds with 404 if there's no such channel
+func withChannel(chMap map[string]*channel.Channel, handler func(w http.ResponseWriter, r *http.Request, ch *channel.Channel)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ch, ok := chMap[r.PathValue("channel")]
+		if !ok {
+			http.Error(w, "Channel not found", http.StatusNotFound)
+			return
+		}
+
+		handler(w, r, ch)
+	}
+}
+
+func scheduleHandler(w http.ResponseWriter, r *http.Request, ch *channel.Channel) {
+	writeJSON(w, ch.Schedule())
+}
+
+// artworkHandler serves the artwork for a scheduled item, or for what's on
+// air without an ID
+func artworkHandler(w http.ResponseWriter, r *http.Request, ch *channel.Channel) {
+	var id uint64
+	if idStr := r.PathValue("id"); idStr != "" {
+		var err error
+		if id, err = strconv.ParseUint(idStr, 10, 64); err != nil {
+			http.Error(w, "Invalid item ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	p, err := ch.Artwork(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	http.ServeFile(w, r, p)
+}
+
+func probeHandler(w http.ResponseWriter, r *http.Request, ch *channel.Channel) {
+	writeJSON(w, ch.ProbeProgress())
+}
+
+func showsHandler(w http.ResponseWriter, r *http.Request, ch *channel.Channel) {
+	writeJSON(w, ch.Shows())
+}
+
+func episodesHandler(w http.ResponseWriter, r *http.Request, ch *channel.Channel) {
+	episodes, err := ch.Episodes(r.PathValue("show"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, episodes)
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request, ch *channel.Channel) {
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		http.Error(w, "Expected a search query q", http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, ch.Search(q))
+}
+
+// validateHandler starts test decoding the channel's library. It runs in the
+// background until it's done or ctx is canceled.
+func validateHandler(ctx context.Context) func(w http.ResponseWriter, r *http.Request, ch *channel.Channel) {
+	return func(w http.ResponseWriter, r *http.Request, ch *channel.Channel) {
+		log.Info("[api] validate library", "channel", ch.Name(), "client", r.RemoteAddr)
+		if err := ch.Validate(ctx); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		// Headers can't be set once the status is written
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, ch.ValidateProgress())
+	}
+}
+
+func validateProgressHandler(w http.ResponseWriter, r *http.Request, ch *channel.Channel) {
+	writeJSON(w, ch.ValidateProgress())
+}
+
+func quarantineHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, channel.Quarantined())
+}
+
+func releaseHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Path == "" {
+		http.Error(w, "Expected a JSON body with a path", http.StatusBadRequest)
+		return
+	}
+
+	log.Info("[api] release from quarantine", "path", body.Path, "client", r.RemoteAddr)
+	if err := channel.Release(body.Path); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, channel.Quarantined())
+}
+
+func enqueueHandler(w http.ResponseWriter, r *http.Request, ch *channel.Channel) {
+	var body struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Path == "" {
+		http.Error(w, "Expected a JSON body with a path", http.StatusBadRequest)
+		return
+	}
+
+	log.Info("[api] enqueue", "channel", ch.Name(), "path", body.Path, "client", r.RemoteAddr)
+	if err := ch.Enqueue(body.Path); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, ch.Schedule())
+}
+
+func insertHandler(w http.ResponseWriter, r *http.Request, ch *channel.Channel) {
+	var body struct {
+		Path string    `json:"path"`
+		At   time.Time `json:"at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Path == "" {
+		http.Error(w, "Expected a JSON body with a path and an RFC 3339 time at", http.StatusBadRequest)
+		return
+	}
+
+	log.Info("[api] insert", "channel", ch.Name(), "path", body.Path, "at", body.At, "client", r.RemoteAddr)
+	if err := ch.Insert(body.Path, body.At); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, ch.Schedule())
+}
+
+func removeHandler(w http.ResponseWriter, r *http.Request, ch *channel.Channel) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid item ID", http.StatusBadRequest)
+		return
+	}
+
+	log.Info("[api] remove", "channel", ch.Name(), "id", id, "client", r.RemoteAddr)
+	if err := ch.Remove(id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, ch.Schedule())
+}
+
+func reorderHandler(w http.ResponseWriter, r *http.Request, ch *channel.Channel) {
+	var body struct {
+		IDs []uint64 `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.IDs) == 0 {
+		http.Error(w, "Expected a JSON body with a list of ids", http.StatusBadRequest)
+		return
+	}
+
+	log.Info("[api] reorder", "channel", ch.Name(), "ids", body.IDs, "client", r.RemoteAddr)
+	if err := ch.Reorder(body.IDs); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, ch.Schedule())
+}
+
+func NewHandler(ctx context.Context, chs []*channel.Channel) http.Handler {
+
+	mux := http.NewServeMux()
+
+	chMap := make(map[string]*channel.Channel)
+	for _, ch := range chs {
+		chMap[ch.PathName()] = ch
+	}
+
+	mux.HandleFunc("GET /channels/{channel}/schedule", withChannel(chMap, scheduleHandler))
+	mux.HandleFunc("POST /channels/{channel}/schedule", withChannel(chMap, insertHandler))
+	mux.HandleFunc("PUT /channels/{channel}/schedule/order", withChannel(chMap, reorderHandler))
+	mux.HandleFunc("DELETE /channels/{channel}/schedule/{id}", withChannel(chMap, removeHandler))
+	mux.HandleFunc("POST /channels/{channel}/queue", withChannel(chMap, enqueueHandler))
+	mux.HandleFunc("GET /channels/{channel}/library/probe", withChannel(chMap, probeHandler))
+	mux.HandleFunc("GET /channels/{channel}/library/shows", withChannel(chMap, showsHandler))
+	mux.HandleFunc("GET /channels/{channel}/library/shows/{show}", withChannel(chMap, episodesHandler))
+	mux.HandleFunc("GET /channels/{channel}/library/search", withChannel(chMap, searchHandler))
+	mux.HandleFunc("GET /channels/{channel}/library/validate", withChannel(chMap, validateProgressHandler))
+	mux.HandleFunc("POST /channels/{channel}/library/validate", withChannel(chMap, validateHandler(ctx)))
+	mux.HandleFunc("GET /library/quarantine", quarantineHandler)
+	mux.HandleFunc("DELETE /library/quarantine", releaseHandler)
+	mux.HandleFunc("GET /channels/{channel}/artwork", withChannel(chMap, artworkHandler))
+	mux.HandleFunc("GET /channels/{channel}/schedule/{id}/artwork", withChannel(chMap, artworkHandler))
+	return mux
+}
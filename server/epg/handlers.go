@@ -0,0 +1,114 @@
+package epg
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+
+	"video-stream/channel"
+	"video-stream/log"
+)
+
+// XMLTV timestamps look like 20251018203000 +0200
+const xmltvTime = "20060102150405 -0700"
+
+type tv struct {
+	XMLName       xml.Name      `xml:"tv"`
+	GeneratorName string        `xml:"generator-info-name,attr"`
+	Channels      []tvChannel   `xml:"channel"`
+	Programmes    []tvProgramme `xml:"programme"`
+}
+
+type tvChannel struct {
+	ID          string `xml:"id,attr"`
+	DisplayName string `xml:"display-name"`
+}
+
+type tvProgramme struct {
+	Start      string         `xml:"start,attr"`
+	Stop       string         `xml:"stop,attr"`
+	Channel    string         `xml:"channel,attr"`
+	Title      string         `xml:"title"`
+	SubTitle   string         `xml:"sub-title,omitempty"`
+	Desc       string         `xml:"desc,omitempty"`
+	EpisodeNum []tvEpisodeNum `xml:"episode-num,omitempty"`
+	Icon       *tvIcon        `xml:"icon,omitempty"`
+}
+
+type tvIcon struct {
+	Src string `xml:"src,attr"`
+}
+
+type tvEpisodeNum struct {
+	System string `xml:"system,attr"`
+	Value  string `xml:",chardata"`
+}
+
+// episodeNums formats season and episode numbers in the two systems IPTV
+// clients commonly understand. xmltv_ns is zero-based.
+func episodeNums(p channel.Programme) []tvEpisodeNum {
+	if p.Season == 0 && p.Episode == 0 {
+		return nil
+	}
+
+	ns := ""
+	if p.Season > 0 {
+		ns = fmt.Sprintf("%d", p.Season-1)
+	}
+	ns += "."
+	if p.Episode > 0 {
+		ns += fmt.Sprintf("%d", p.Episode-1)
+	}
+	ns += "."
+
+	return []tvEpisodeNum{
+		{System: "xmltv_ns", Value: ns},
+		{System: "onscreen", Value: fmt.Sprintf("S%02dE%02d", p.Season, p.Episode)},
+	}
+}
+
+// NewHandler serves an XMLTV guide built from the schedules of all channels.
+// Channel IDs match the tvg-id attributes in the stream playlist.
+func NewHandler(chs []*channel.Channel) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Info("[HTTP Server] client requested epg.xml", "client", r.RemoteAddr)
+
+		guide := tv{GeneratorName: "video-stream"}
+
+		for _, ch := range chs {
+			guide.Channels = append(guide.Channels, tvChannel{
+				ID:          ch.PathName(),
+				DisplayName: ch.Name(),
+			})
+
+			for _, p := range ch.Guide() {
+				var icon *tvIcon
+				if p.HasArtwork {
+					icon = &tvIcon{Src: fmt.Sprintf("http://%s/api/channels/%s/schedule/%d/artwork", r.Host, ch.PathName(), p.ID)}
+				}
+
+				guide.Programmes = append(guide.Programmes, tvProgramme{
+					Start:      p.Start.Format(xmltvTime),
+					Stop:       p.End.Format(xmltvTime),
+					Channel:    ch.PathName(),
+					Title:      p.Title,
+					SubTitle:   p.EpisodeTitle,
+					Desc:       p.Description,
+					EpisodeNum: episodeNums(p),
+					Icon:       icon,
+				})
+			}
+		}
+
+		out, err := xml.MarshalIndent(guide, "", "  ")
+		if err != nil {
+			log.Error("[epg] could not marshal guide", "error", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(xml.Header))
+		w.Write(out)
+	})
+}
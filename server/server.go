@@ -9,6 +9,8 @@ import (
 	"video-stream/channel"
 	"video-stream/log"
 
+	"video-stream/server/api"
+	"video-stream/server/epg"
 	"video-stream/server/stream"
 	"video-stream/server/web"
 )
@@ -18,6 +20,8 @@ func Start(ctx context.Context, chs []*channel.Channel) {
 
 	http.Handle("/web/", http.StripPrefix("/web", web.NewHandler(ctx, chs)))
 	http.Handle("/stream/", http.StripPrefix("/stream", stream.NewHandler(ctx, chs)))
+	http.Handle("/api/", http.StripPrefix("/api", api.NewHandler(ctx, chs)))
+	http.Handle("/epg.xml", epg.NewHandler(chs))
 
 	http.Handle("/favicon.ico", http.RedirectHandler("/web/static/favicon.ico", http.StatusMovedPermanently))
 
@@ -17,7 +17,7 @@ func NewHandler(ctx context.Context, chs []*channel.Channel) http.Handler {
 
 	// Set up m3u file
 	var playlist = []string{
-		"#EXTM3U",
+		fmt.Sprintf(`#EXTM3U url-tvg="http://%s:8080/epg.xml"`, ip),
 		"#PLAYLIST Channels",
 	}
 
@@ -26,7 +26,7 @@ func NewHandler(ctx context.Context, chs []*channel.Channel) http.Handler {
 		streamRoute := fmt.Sprintf("/%s.ts", strings.ToLower(strings.ReplaceAll(ch.Name(), " ", "-")))
 
 		playlist = append(playlist,
-			fmt.Sprintf(`#EXTINF:-1, %s`, ch.Name()),
+			fmt.Sprintf(`#EXTINF:-1 tvg-id="%s" tvg-name="%s" tvg-logo="http://%s:8080/api/channels/%s/artwork", %s`, ch.PathName(), ch.Name(), ip, ch.PathName(), ch.Name()),
 			fmt.Sprintf(`http://%s:8080%s`, ip, streamRoute),
 		)
 